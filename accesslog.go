@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Access log: one record per HTTP request, CONNECT tunnel or SOCKS command,
+// written to access_log (a file or stdout) without the timestamp prefix of the
+// regular log.
+
+// accessChan carries formatted records to the writer; nil when access_log is off
+var accessChan chan string
+
+// accessRecord collects what happened to one request or tunnel
+type accessRecord struct {
+	conn        *connInfo
+	start       time.Time
+	mode        string // http, socks4 or socks5
+	method      string // HTTP method, or CONNECT, BIND, UDP_ASSOCIATE for SOCKS
+	destination string // host:port asked for
+	user        string
+	resolvedIP  string // address the proxy connected to
+	status      int    // HTTP status, SOCKS5 reply code or SOCKS4 code (90/91)
+
+	// HTTP request details for the squid and combined formats
+	url       string
+	version   string
+	referer   string
+	userAgent string
+
+	bytesIn  atomic.Int64 // read from the client
+	bytesOut atomic.Int64 // written to the client
+}
+
+// newRecord starts a record for a request on the connection. The admin API lists
+// it as the connection's current request until done is called.
+func (ci *connInfo) newRecord(mode, method, destination, user string) *accessRecord {
+	r := &accessRecord{conn: ci, start: time.Now(), mode: mode, method: method, destination: destination, user: user}
+	ci.attach(r)
+	return r
+}
+
+// setUser notes the user once the request is authenticated
+func (r *accessRecord) setUser(user string) {
+	r.conn.mu.Lock()
+	r.user = user
+	if r.conn.rec == r {
+		r.conn.user = user
+	}
+	r.conn.mu.Unlock()
+}
+
+// setRemote notes the outbound connection, so killing the client connection ends the tunnel too
+func (r *accessRecord) setRemote(c net.Conn) {
+	r.conn.mu.Lock()
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		r.resolvedIP = a.IP.String()
+	}
+	if r.conn.rec == r {
+		r.conn.remote = c
+	}
+	r.conn.mu.Unlock()
+}
+
+// replier wraps a SOCKS replier so the reply code ends up in the record
+func (r *accessRecord) replier(reply socksReplier) socksReplier {
+	return func(rep byte, addr net.Addr) error {
+		r.status = int(rep)
+		if r.mode == "socks4" {
+			r.status = socks4Rejected
+			if rep == 0x00 {
+				r.status = socks4Granted
+			}
+		}
+		return reply(rep, addr)
+	}
+}
+
+// done ends the record: its bytes are added to the metrics and, with access_log on, it is written
+func (r *accessRecord) done() {
+	r.conn.detach(r)
+	in, out := r.bytesIn.Load(), r.bytesOut.Load()
+	metrics.bytesIn.Add(in)
+	metrics.bytesOut.Add(out)
+	if accessChan == nil {
+		return
+	}
+	accessChan <- accessFormat(r, in, out, time.Since(r.start))
+}
+
+// accessFormatter renders a finished record as one line
+type accessFormatter func(r *accessRecord, in, out int64, d time.Duration) string
+
+// accessFormats maps access_log_format values to their formatters
+var accessFormats = map[string]accessFormatter{
+	"json":     formatAccessJSON,
+	"squid":    formatAccessSquid,
+	"combined": formatAccessCombined,
+}
+
+// accessFormat is the formatter selected by access_log_format
+var accessFormat accessFormatter = formatAccessJSON
+
+// accessJSON is the JSON form of a record
+type accessJSON struct {
+	Time        string  `json:"time"`
+	ConnID      uint64  `json:"conn_id"`
+	ClientIP    string  `json:"client_ip"`
+	User        string  `json:"user"`
+	Mode        string  `json:"mode"`
+	Method      string  `json:"method"`
+	Destination string  `json:"destination"`
+	ResolvedIP  string  `json:"resolved_ip"`
+	Status      int     `json:"status"`
+	BytesIn     int64   `json:"bytes_in"`
+	BytesOut    int64   `json:"bytes_out"`
+	DurationMs  float64 `json:"duration_ms"`
+}
+
+// formatAccessJSON renders a record as one JSON line
+func formatAccessJSON(r *accessRecord, in, out int64, d time.Duration) string {
+	b, _ := json.Marshal(accessJSON{
+		Time:        r.start.Format(time.RFC3339Nano),
+		ConnID:      r.conn.id,
+		ClientIP:    r.conn.clientIP,
+		User:        r.user,
+		Mode:        r.mode,
+		Method:      r.method,
+		Destination: r.destination,
+		ResolvedIP:  r.resolvedIP,
+		Status:      r.status,
+		BytesIn:     in,
+		BytesOut:    out,
+		DurationMs:  float64(d.Microseconds()) / 1000,
+	})
+	return string(b)
+}
+
+// httpStatus returns the HTTP status of a record; SOCKS reply codes are mapped
+// onto the nearest HTTP status so text-log tools can read every record alike
+func (r *accessRecord) httpStatus() int {
+	if r.mode == "http" {
+		return r.status
+	}
+	switch r.status {
+	case 0x00, socks4Granted:
+		// A SOCKS5 record starts at 0x00, so success needs a reply as well as the code
+		if r.resolvedIP != "" || r.method == "UDP_ASSOCIATE" {
+			return 200
+		}
+		return 0
+	case 0x02, socks4Rejected:
+		return 403
+	case 0x03, 0x04, 0x05, 0x06:
+		return 503
+	case 0x07, 0x08:
+		return 501
+	}
+	return 502
+}
+
+// requestURL returns the request URL, or host:port for tunnels
+func (r *accessRecord) requestURL() string {
+	if r.url != "" {
+		return r.url
+	}
+	if r.destination != "" {
+		return r.destination
+	}
+	return "-"
+}
+
+// squidAction returns the Squid result code (TCP_MISS, TCP_TUNNEL, ...) of a record
+func squidAction(r *accessRecord, status int) string {
+	switch {
+	case r.resolvedIP == "" && (status == 403 || status == 407 || status == 429):
+		// Refused by the proxy itself
+		return "TCP_DENIED"
+	case r.resolvedIP == "" && r.method != "UDP_ASSOCIATE":
+		return "NONE"
+	case r.mode != "http" || r.method == "CONNECT":
+		return "TCP_TUNNEL"
+	}
+	return "TCP_MISS"
+}
+
+// formatAccessSquid renders a record in Squid's native access.log format:
+// time elapsed client action/code size method URL user hierarchy/from type
+func formatAccessSquid(r *accessRecord, in, out int64, d time.Duration) string {
+	end := r.start.Add(d)
+	status := r.httpStatus()
+	hierarchy := "HIER_NONE/-"
+	if r.resolvedIP != "" {
+		hierarchy = "HIER_DIRECT/" + r.resolvedIP
+	}
+	return fmt.Sprintf("%d.%03d %6d %s %s/%03d %d %s %s %s %s -",
+		end.Unix(), end.Nanosecond()/int(time.Millisecond), d.Milliseconds(), r.conn.clientIP,
+		squidAction(r, status), status, out, squidField(r.method), squidURL(r.requestURL()), squidField(r.user), hierarchy)
+}
+
+// squidField percent-encodes a field for a space-separated line; empty fields become "-"
+func squidField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return url.PathEscape(s)
+}
+
+// squidURL percent-encodes the spaces, control bytes and non-ASCII bytes of a
+// URL, which would otherwise split or forge a space-separated line
+func squidURL(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c >= 0x7f {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// formatAccessCombined renders a record in the Apache combined log format:
+// client - user [time] "request" status size "referer" "user-agent"
+func formatAccessCombined(r *accessRecord, in, out int64, d time.Duration) string {
+	version := r.version
+	if version == "" {
+		version = strings.ToUpper(r.mode)
+	}
+	size := "-"
+	if out > 0 {
+		size = strconv.FormatInt(out, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %03d %s \"%s\" \"%s\"",
+		r.conn.clientIP, squidField(r.user), r.start.Format("02/Jan/2006:15:04:05 -0700"),
+		quoteField(r.method), quoteField(r.requestURL()), quoteField(version), r.httpStatus(), size,
+		quoteField(orDash(r.referer)), quoteField(orDash(r.userAgent)))
+}
+
+// quoteField escapes a value written inside double quotes the way Apache does
+func quoteField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// orDash returns "-" for an empty value
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// startAccessLog opens access_log and starts a writer using access_log_format
+func startAccessLog(path, format string) error {
+	out := os.Stdout
+	if path != "stdout" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+
+	accessFormat = accessFormats[format]
+	accessChan = make(chan string, logChanBufferSize)
+	go func() {
+		for line := range accessChan {
+			fmt.Fprintln(out, line)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogForgedFields(t *testing.T) {
+	r := &accessRecord{
+		conn:    &connInfo{clientIP: "10.0.0.5"},
+		start:   time.Unix(1700000000, 0),
+		mode:    "http",
+		method:  "GET",
+		url:     "http://a/x HTTP/1.1\" 200 0\n10.0.0.9 - admin [x] \"GET /",
+		version: "HTTP/1.1",
+		user:    "bob x",
+		status:  200,
+	}
+	for name, format := range map[string]func(*accessRecord, int64, int64, time.Duration) string{
+		"squid":    formatAccessSquid,
+		"combined": formatAccessCombined,
+	} {
+		line := format(r, 0, 0, time.Second)
+		if strings.ContainsAny(line, "\n\r") {
+			t.Errorf("%s: line break in %q", name, line)
+		}
+	}
+
+	squid := strings.Fields(formatAccessSquid(r, 0, 0, time.Second))
+	if len(squid) != 10 || squid[6] != `http://a/x%20HTTP/1.1"%20200%200%0A10.0.0.9%20-%20admin%20[x]%20"GET%20/` {
+		t.Errorf("squid fields %q", squid)
+	}
+	combined := formatAccessCombined(r, 0, 0, time.Second)
+	if want := `"GET http://a/x HTTP/1.1\" 200 0\x0a10.0.0.9 - admin [x] \"GET / HTTP/1.1" 200`; !strings.Contains(combined, want) {
+		t.Errorf("combined %q, want it to contain %q", combined, want)
+	}
+}
+
+func TestValidHostname(t *testing.T) {
+	for host, want := range map[string]bool{
+		"example.com":            true,
+		"_srv.Example-1.org.":    true,
+		"192.0.2.1":              true,
+		"2001:db8::1":            true,
+		"":                       false,
+		"a b":                    false,
+		"a\nb":                   false,
+		"a\x00b":                 false,
+		"exämple.com":            false,
+		`a"b`:                    false,
+		strings.Repeat("a", 256): false,
+	} {
+		if got := validHostname(host); got != want {
+			t.Errorf("validHostname(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	// A datagram naming a forged host is dropped
+	pkt := append([]byte{0, 0, 0, 0x03, 3}, "a\nb"...)
+	if _, _, err := parseSocksUDPHeader(append(pkt, 0, 53)); err == nil {
+		t.Error("datagram to \"a\\nb\" accepted")
+	}
+}
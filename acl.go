@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// errDestinationDenied is returned by dialTarget when a dest_rule denies the destination
+var errDestinationDenied = errors.New("destination denied by dest_rule")
+
+// isNotAllowed reports whether a dial failed because policy forbids the destination
+func isNotAllowed(err error) bool {
+	return errors.Is(err, errDestinationDenied) || errors.Is(err, errRouteRejected) ||
+		errors.Is(err, errPrivateDestination)
+}
+
+// aclRule allows or denies destinations matching a destMatcher
+type aclRule struct {
+	allow   bool
+	matcher *destMatcher
+}
+
+// parseACLRule parses "<allow|deny> <domain|cidr|port> <value>"
+func parseACLRule(val string) (*aclRule, error) {
+	fields := strings.Fields(val)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid dest_rule %q: want \"<allow|deny> <domain|cidr|port> <value>\"", val)
+	}
+
+	r := &aclRule{}
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		r.allow = true
+	case "deny":
+		r.allow = false
+	default:
+		return nil, fmt.Errorf("invalid dest_rule %q: action must be allow or deny", val)
+	}
+
+	m, err := parseDestMatcher(fields[1], fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid dest_rule %q: %v", val, err)
+	}
+	r.matcher = m
+	return r, nil
+}
+
+// evalACL returns the verdict of the first matching rule
+func evalACL(rules []*aclRule, d *destination) (allow, matched bool) {
+	for _, r := range rules {
+		if r.matcher.matches(d) {
+			return r.allow, true
+		}
+	}
+	return false, false
+}
+
+// destinationAllowed applies dest_rule lines in order; the first match wins
+// and dest_default decides when nothing matches. The rules of the user's
+// policy come before the global ones.
+func destinationAllowed(d *destination) bool {
+	if p := policyFor(d.user); p != nil {
+		if allow, matched := evalACL(p.destRules, d); matched {
+			return allow
+		}
+		if p.destDefault != nil {
+			return *p.destDefault
+		}
+	}
+	if allow, matched := evalACL(cfg.DestRules, d); matched {
+		return allow
+	}
+	return cfg.DestDefaultAllow
+}
+
+// aclActive reports whether destinations need to be checked at all
+func aclActive() bool {
+	return len(cfg.DestRules) > 0 || !cfg.DestDefaultAllow || cfg.userDestRules
+}
+
+// errPrivateDestination is returned when block_private_destinations stops a dial
+var errPrivateDestination = errors.New("private destination blocked")
+
+// privateNetworks are the ranges block_private_destinations refuses to dial
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network, includes 0.0.0.0
+	"10.0.0.0/8",     // RFC 1918
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, includes cloud metadata services
+	"172.16.0.0/12",  // RFC 1918
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // RFC 1918
+	"198.18.0.0/15",  // benchmarking, used for internal networks too
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, includes the limited broadcast address
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // NAT64, reaches IPv4 addresses through a translator
+	"100::/64",       // discard-only
+	"2001:db8::/32",  // documentation
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+// mustParseCIDRs parses built-in network lists
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// privateDestination reports whether ip is internal and not listed in private_destination_allow
+func privateDestination(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		// IPv4-mapped IPv6 addresses reach the IPv4 host
+		ip = ip4
+	}
+	for _, n := range cfg.PrivateAllow {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclDialer connects directly like directDialer and applies dest_rule lines to
+// each address right before connecting to it. A cidr rule checked on a separate
+// lookup could be bypassed by a name that resolves differently at dial time.
+type aclDialer struct {
+	dst *destination
+}
+
+// Dial connects to hostPort if the rules allow the resolved address
+func (a aclDialer) Dial(hostPort string) (net.Conn, error) {
+	d := net.Dialer{Control: a.checkAddress}
+	return d.Dial("tcp", hostPort)
+}
+
+// checkAddress is the net.Dialer Control hook of aclDialer
+func (a aclDialer) checkAddress(network, address string, c syscall.RawConn) error {
+	if cfg.BlockPrivate {
+		if err := checkDialAddress(network, address, c); err != nil {
+			return err
+		}
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unexpected dial address %q", address)
+	}
+	// A copy per address: IPv4 and IPv6 attempts may run concurrently
+	d := *a.dst
+	d.ips, d.resolved = []net.IP{ip}, true
+	if !destinationAllowed(&d) {
+		return errDestinationDenied
+	}
+	return nil
+}
+
+// checkDialAddress is a net.Dialer Control hook. It sees the address after DNS
+// resolution, right before connect, so a name can't be re-pointed at an internal
+// address between the check and the dial.
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && privateDestination(ip) {
+		return errPrivateDestination
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCheckDialAddress(t *testing.T) {
+	defer func(allow []*net.IPNet) { cfg.PrivateAllow = allow }(cfg.PrivateAllow)
+	cfg.PrivateAllow = mustParseCIDRs("10.1.2.0/24", "fd00:1::/64")
+
+	tests := []struct {
+		address string
+		blocked bool
+	}{
+		{"0.0.0.0:80", true},
+		{"10.0.0.1:80", true},
+		{"10.1.2.3:80", false}, // private_destination_allow
+		{"100.64.0.1:80", true},
+		{"127.0.0.1:80", true},
+		{"127.255.255.254:80", true},
+		{"169.254.169.254:80", true},
+		{"172.16.0.1:80", true},
+		{"172.32.0.1:80", false},
+		{"192.0.0.8:80", true},
+		{"192.0.2.1:80", false},
+		{"192.168.1.1:80", true},
+		{"198.18.0.1:80", true},
+		{"198.19.255.254:80", true},
+		{"198.20.0.1:80", false},
+		{"224.0.0.251:5353", true},
+		{"239.255.255.250:1900", true},
+		{"240.0.0.1:80", true},
+		{"255.255.255.255:67", true},
+		{"8.8.8.8:53", false},
+		{"[::]:80", true},
+		{"[::1]:80", true},
+		{"[::ffff:127.0.0.1]:80", true},
+		{"[::ffff:10.0.0.1]:80", true},
+		{"[::ffff:8.8.8.8]:80", false},
+		{"[64:ff9b::a9fe:a9fe]:80", true},
+		{"[100::1]:80", true},
+		{"[100:0:0:1::1]:80", false},
+		{"[2001:db8::1]:80", true},
+		{"[fc00::1]:80", true},
+		{"[fd00:1::5]:80", false}, // private_destination_allow
+		{"[fe80::1]:80", true},
+		{"[ff02::1]:80", true},
+		{"[2001:4860:4860::8888]:53", false},
+	}
+	for _, tt := range tests {
+		err := checkDialAddress("tcp", tt.address, nil)
+		if blocked := err == errPrivateDestination; blocked != tt.blocked {
+			t.Errorf("%s: err = %v, want blocked %v", tt.address, err, tt.blocked)
+		}
+	}
+
+	if err := checkDialAddress("tcp", "no-port", nil); err == nil {
+		t.Error("address without port: no error")
+	}
+}
+
+func TestACLDialerChecksDialedAddress(t *testing.T) {
+	defer func(rules []*aclRule, allow bool) { cfg.DestRules, cfg.DestDefaultAllow = rules, allow }(cfg.DestRules, cfg.DestDefaultAllow)
+	rule, err := parseACLRule("deny cidr 127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DestRules, cfg.DestDefaultAllow = []*aclRule{rule}, true
+
+	// The name resolved to a public address when the rules were first checked
+	dst := &destination{host: "rebind.example", port: 80, ips: []net.IP{net.ParseIP("192.0.2.10")}, resolved: true}
+	if !destinationAllowed(dst) {
+		t.Fatal("public address denied")
+	}
+	a := aclDialer{dst: dst}
+	if err := a.checkAddress("tcp", "127.0.0.1:80", nil); err != errDestinationDenied {
+		t.Errorf("rebound address: err = %v, want %v", err, errDestinationDenied)
+	}
+	if err := a.checkAddress("tcp", "192.0.2.10:80", nil); err != nil {
+		t.Errorf("public address: %v", err)
+	}
+	if !dst.ips[0].Equal(net.ParseIP("192.0.2.10")) {
+		t.Error("checkAddress changed the shared destination")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn, err := a.Dial(net.JoinHostPort("localhost", port))
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialed a denied address")
+	}
+	if !errors.Is(err, errDestinationDenied) || !isNotAllowed(err) {
+		t.Errorf("err = %v, want %v", err, errDestinationDenied)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Admin API on admin_listen: live connections, killing them, the effective
+// config, the build version and the log level. It has no authentication, so
+// it only listens on loopback addresses; changes need DELETE or PUT, which a
+// web page cannot send cross-origin without a preflight the API never answers.
+
+// version is set at build time: go build -ldflags "-X main.version=1.3"
+var version = "dev"
+
+// checkLoopbackAddr accepts host:port addresses on the loopback interface
+func checkLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%q is not a loopback address such as 127.0.0.1:9465", addr)
+	}
+	return nil
+}
+
+// serveAdmin serves the admin API on ln until the listener is closed
+func serveAdmin(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", adminListConnections)
+	mux.HandleFunc("DELETE /connections", adminKillConnections)
+	mux.HandleFunc("DELETE /connections/{id}", adminKillConnection)
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, effectiveConfig())
+	})
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, buildVersion())
+	})
+	mux.HandleFunc("GET /log-level", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, map[string]string{"level": getLogLevel().String()})
+	})
+	mux.HandleFunc("PUT /log-level", adminSetLogLevel)
+
+	srv := &http.Server{Handler: adminHostCheck(mux), ReadHeaderTimeout: 10 * time.Second}
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+		logError("admin server stopped", "err", err)
+	}
+}
+
+// adminHostCheck refuses requests for other host names, so a DNS rebinding
+// page cannot read the API through the browser
+func adminHostCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if host != "localhost" && net.ParseIP(host) == nil {
+			writeAdminError(w, http.StatusForbidden, "host not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAdminJSON writes v as indented JSON
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeAdminError writes {"error": msg}
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, map[string]string{"error": msg})
+}
+
+// adminConn is one entry of GET /connections
+type adminConn struct {
+	ID        uint64    `json:"id"` // conn_id in the access log
+	Client    string    `json:"client"`
+	Mode      string    `json:"mode"` // http or socks
+	Connected time.Time `json:"connected"`
+	User      string    `json:"user"`
+
+	// The tunnel or request in progress, empty between requests
+	Protocol    string     `json:"protocol,omitempty"` // http, socks4 or socks5
+	Method      string     `json:"method,omitempty"`
+	Destination string     `json:"destination,omitempty"`
+	ResolvedIP  string     `json:"resolved_ip,omitempty"`
+	Started     *time.Time `json:"started,omitempty"`
+	BytesIn     int64      `json:"bytes_in"`
+	BytesOut    int64      `json:"bytes_out"`
+}
+
+// connFilter selects connections by the user and client query parameters
+type connFilter struct {
+	user     string
+	clientIP net.IP
+}
+
+// parseConnFilter reads ?user= and ?client=
+func parseConnFilter(q url.Values) (connFilter, error) {
+	f := connFilter{user: q.Get("user")}
+	if c := q.Get("client"); c != "" {
+		if f.clientIP = net.ParseIP(c); f.clientIP == nil {
+			return f, fmt.Errorf("invalid client IP %q", c)
+		}
+	}
+	return f, nil
+}
+
+// empty reports whether the filter selects everything
+func (f connFilter) empty() bool {
+	return f.user == "" && f.clientIP == nil
+}
+
+// match reports whether ci is selected
+func (f connFilter) match(ci *connInfo, user string) bool {
+	if f.user != "" && user != f.user {
+		return false
+	}
+	return f.clientIP == nil || f.clientIP.Equal(net.ParseIP(ci.clientIP))
+}
+
+// adminListConnections answers GET /connections[?user=&client=]
+func adminListConnections(w http.ResponseWriter, r *http.Request) {
+	f, err := parseConnFilter(r.URL.Query())
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	list := []adminConn{}
+	for _, ci := range connections() {
+		rec, user, resolvedIP := ci.current()
+		if !f.match(ci, user) {
+			continue
+		}
+		c := adminConn{ID: ci.id, Client: ci.clientAddr, Mode: ci.mode, Connected: ci.start, User: user}
+		if rec != nil {
+			c.Protocol, c.Method, c.Destination, c.ResolvedIP = rec.mode, rec.method, rec.destination, resolvedIP
+			c.Started = &rec.start
+			c.BytesIn, c.BytesOut = rec.bytesIn.Load(), rec.bytesOut.Load()
+		}
+		list = append(list, c)
+	}
+	writeAdminJSON(w, http.StatusOK, list)
+}
+
+// adminKillConnection answers DELETE /connections/{id}
+func adminKillConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid connection id")
+		return
+	}
+	activeConns.Lock()
+	ci := activeConns.m[id]
+	activeConns.Unlock()
+	if ci == nil {
+		writeAdminError(w, http.StatusNotFound, "no such connection")
+		return
+	}
+	killConn(ci)
+	writeAdminJSON(w, http.StatusOK, map[string]int{"killed": 1})
+}
+
+// adminKillConnections answers DELETE /connections?user=&client=; a filter is required
+func adminKillConnections(w http.ResponseWriter, r *http.Request) {
+	f, err := parseConnFilter(r.URL.Query())
+	if err == nil && f.empty() {
+		err = errors.New("user or client required")
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	killed := 0
+	for _, ci := range connections() {
+		if _, user, _ := ci.current(); f.match(ci, user) {
+			killConn(ci)
+			killed++
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]int{"killed": killed})
+}
+
+// killConn closes a connection on an operator's request
+func killConn(ci *connInfo) {
+	_, user, _ := ci.current()
+	logInfo("connection killed by admin", "id", ci.id, "client", ci.clientAddr, "user", user)
+	ci.kill()
+}
+
+// adminSetLogLevel answers PUT /log-level?level=debug
+func adminSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	level, err := parseLogLevel(r.URL.Query().Get("level"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	setLogLevel(level)
+	writeAdminJSON(w, http.StatusOK, map[string]string{"level": level.String()})
+}
+
+// buildVersion describes the running binary
+func buildVersion() map[string]any {
+	v := map[string]any{"version": version, "go": runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				v["revision"] = s.Value
+			case "vcs.modified":
+				v["modified"] = s.Value == "true"
+			}
+		}
+	}
+	return v
+}
+
+// adminListener is a listener in GET /config; passwords are left out
+type adminListener struct {
+	Name          string   `json:"name,omitempty"`
+	Mode          string   `json:"proxy_mode"`
+	Address       string   `json:"address"`
+	Port          int      `json:"port"`
+	AllowedIPs    []string `json:"allowed_ip"`
+	AuthRequired  bool     `json:"auth_required"`
+	AuthBackend   string   `json:"auth_backend"`
+	AuthScheme    string   `json:"auth_scheme"`
+	AuthUser      string   `json:"auth_user,omitempty"`
+	AuthFile      string   `json:"auth_file,omitempty"`
+	TLSCert       string   `json:"tls_cert,omitempty"`
+	TLSKey        string   `json:"tls_key,omitempty"`
+	TLSMinVersion string   `json:"tls_min_version,omitempty"`
+	TLSClientCA   string   `json:"tls_client_ca,omitempty"`
+	TLSClientAuth string   `json:"tls_client_auth,omitempty"`
+	TLSClientUser string   `json:"tls_client_user,omitempty"`
+}
+
+// effectiveConfig renders the running configuration, defaults included, under
+// the config file's key names. Secrets are left out.
+func effectiveConfig() map[string]any {
+	upstreams := make(map[string]string, len(cfg.Upstreams))
+	for name, d := range cfg.Upstreams {
+		upstreams[name] = dialerName(d)
+	}
+	users := make([]string, 0, len(cfg.Users))
+	for name := range cfg.Users {
+		users = append(users, name)
+	}
+	slices.Sort(users)
+	destDefault := "deny"
+	if cfg.DestDefaultAllow {
+		destDefault = "allow"
+	}
+
+	a := cfg.authLimit
+	c := map[string]any{
+		"log_level":                  getLogLevel().String(),
+		"idle_timeout":               cfg.IdleTimeout.String(),
+		"buffer_size":                cfg.BufferSize,
+		"upstream_proxy":             dialerName(cfg.Upstream),
+		"upstreams":                  upstreams,
+		"route_rules":                len(cfg.Routes),
+		"dest_rules":                 len(cfg.DestRules),
+		"dest_default":               destDefault,
+		"block_private_destinations": cfg.BlockPrivate,
+		"add_via":                    cfg.AddVia,
+		"add_forwarded":              cfg.AddForwarded,
+		"add_x_forwarded_for":        cfg.AddXForwardedFor,
+		"metrics_listen":             cfg.MetricsListen,
+		"admin_listen":               cfg.AdminListen,
+		"access_log":                 cfg.AccessLog,
+		"access_log_format":          cfg.AccessLogFormat,
+		"auth_max_failures":          a.maxIPFailures,
+		"auth_max_user_failures":     a.maxUserFailures,
+		"auth_failure_window":        a.window.String(),
+		"auth_failure_delay":         a.delay.String(),
+		"auth_ban_time":              a.banTime.String(),
+		"auth_max_ban_time":          a.maxBanTime.String(),
+		"users":                      users,
+	}
+	if cfg.WebhookURL != "" {
+		c["auth_webhook_url"] = redactURL(cfg.WebhookURL)
+		c["auth_webhook_timeout"] = cfg.WebhookTimeout.String()
+		c["auth_webhook_ttl"] = cfg.WebhookTTL.String()
+	}
+	if cfg.ldap.url != "" {
+		c["ldap_url"] = redactURL(cfg.ldap.url)
+		c["ldap_bind_dn"] = cfg.ldap.bindDN
+	}
+
+	listeners := make([]adminListener, 0, len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		al := adminListener{
+			Name:         l.Name,
+			Mode:         strings.ToLower(l.modeName()),
+			Address:      l.Address,
+			Port:         l.Port,
+			AllowedIPs:   l.AllowedIPs,
+			AuthRequired: l.AuthRequired,
+			AuthBackend:  l.AuthBackend,
+			AuthScheme:   l.AuthScheme,
+			AuthUser:     l.AuthUsername,
+			AuthFile:     l.AuthFile,
+		}
+		if l.tlsConfig != nil {
+			al.TLSCert, al.TLSKey = l.TLSCert, l.TLSKey
+			al.TLSMinVersion = tlsVersionName(l.TLSMinVersion)
+			if l.TLSClientCA != "" {
+				al.TLSClientCA, al.TLSClientAuth, al.TLSClientUser = l.TLSClientCA, l.TLSClientAuth, l.TLSClientUser
+			}
+		}
+		listeners = append(listeners, al)
+	}
+	c["listeners"] = listeners
+	return c
+}
+
+// dialerName describes an outbound dialer without its credentials
+func dialerName(d Dialer) string {
+	if u, ok := d.(*upstreamDialer); ok {
+		if u.username != "" {
+			return u.scheme + "://" + u.username + "@" + u.addr
+		}
+		return u.scheme + "://" + u.addr
+	}
+	return "direct"
+}
+
+// redactURL hides the password of a URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid)"
+	}
+	return u.Redacted()
+}
+
+// tlsVersionName turns a protocol version back into its tls_min_version value
+func tlsVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return name
+		}
+	}
+	return strconv.Itoa(int(v))
+}
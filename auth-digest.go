@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP Digest access authentication (RFC 7616) for HTTP listeners.
+// Digest needs the plaintext password, so it verifies the auth_user / auth_pass account.
+
+// authRealm is the realm advertised in every challenge
+const authRealm = "GGProxy"
+
+const (
+	digestNonceTTL  = 5 * time.Minute // a nonce is accepted this long after it was issued
+	digestMaxNonces = 100000          // bound on the nonce-count table
+)
+
+// Accepted auth_scheme values
+const (
+	authSchemeBasic  = "basic"
+	authSchemeDigest = "digest"
+	authSchemeBoth   = "both"
+)
+
+// digestAuth issues and verifies Digest challenges for one listener
+type digestAuth struct {
+	username string
+	password string
+	secret   []byte // HMAC key for stateless nonces
+	opaque   string
+
+	mu   sync.Mutex
+	seen map[string]digestNonce // nonce -> highest nonce count used
+}
+
+// digestNonce tracks the nonce counts already used with a nonce
+type digestNonce struct {
+	lastNC  uint64
+	expires time.Time
+}
+
+// newDigestAuth creates the verifier for the static account
+func newDigestAuth(username, password string) *digestAuth {
+	d := &digestAuth{
+		username: username,
+		password: password,
+		secret:   make([]byte, 32),
+		seen:     make(map[string]digestNonce),
+	}
+	rand.Read(d.secret)
+	opaque := make([]byte, 16)
+	rand.Read(opaque)
+	d.opaque = hex.EncodeToString(opaque)
+	return d
+}
+
+// newNonce returns base64(issue time | random | HMAC of both), so nonces
+// can be checked without remembering every one handed out
+func (d *digestAuth) newNonce() string {
+	return d.nonceAt(time.Now())
+}
+
+// nonceAt returns a nonce issued at t
+func (d *digestAuth) nonceAt(t time.Time) string {
+	var b [8 + 8 + 16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(t.Unix()))
+	rand.Read(b[8:16])
+	copy(b[16:], d.nonceMAC(b[:16]))
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// nonceMAC authenticates the first 16 bytes of a nonce
+func (d *digestAuth) nonceMAC(b []byte) []byte {
+	m := hmac.New(sha256.New, d.secret)
+	m.Write(b)
+	return m.Sum(nil)[:16]
+}
+
+// nonceTime checks a nonce's MAC and returns when it was issued
+func (d *digestAuth) nonceTime(nonce string) (time.Time, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 32 {
+		return time.Time{}, false
+	}
+	if !hmac.Equal(b[16:], d.nonceMAC(b[:16])) {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0), true
+}
+
+// challenges returns the Proxy-Authenticate header lines, strongest algorithm first
+func (d *digestAuth) challenges(stale bool) string {
+	nonce := d.newNonce()
+	var b strings.Builder
+	for _, alg := range []string{"SHA-256", "MD5"} {
+		b.WriteString(`Proxy-Authenticate: Digest realm="` + authRealm + `", qop="auth", algorithm=` + alg +
+			`, nonce="` + nonce + `", opaque="` + d.opaque + `"`)
+		if stale {
+			b.WriteString(", stale=true")
+		}
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+// digestResult is the outcome of checking a Digest Proxy-Authorization
+type digestResult int
+
+const (
+	digestBad   digestResult = iota
+	digestOK                 // credentials valid and nonce count fresh
+	digestStale              // valid response for an expired nonce; the client may retry silently
+)
+
+// verify checks a Digest Proxy-Authorization value for a request
+func (d *digestAuth) verify(params, method, requestURI string) digestResult {
+	p := parseDigestParams(params)
+
+	var newHash func() hash.Hash
+	alg := strings.ToUpper(p["algorithm"])
+	switch strings.TrimSuffix(alg, "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return digestBad
+	}
+	if p["qop"] != "auth" || p["realm"] != authRealm || p["opaque"] != d.opaque {
+		return digestBad
+	}
+	// The credentials are only good for the request they were computed for
+	if !digestURIMatches(p["uri"], requestURI) {
+		return digestBad
+	}
+	nc, err := strconv.ParseUint(p["nc"], 16, 32)
+	if err != nil || nc == 0 || p["cnonce"] == "" {
+		return digestBad
+	}
+	nonce := p["nonce"]
+	issued, ok := d.nonceTime(nonce)
+	if !ok {
+		return digestBad
+	}
+
+	expected := digestResponse(newHash, strings.HasSuffix(alg, "-SESS"), d.username, authRealm, d.password,
+		nonce, p["nc"], p["cnonce"], method, p["uri"])
+
+	userOK := subtle.ConstantTimeCompare([]byte(p["username"]), []byte(d.username))
+	respOK := subtle.ConstantTimeCompare([]byte(strings.ToLower(p["response"])), []byte(expected))
+	if userOK&respOK != 1 {
+		return digestBad
+	}
+
+	now := time.Now()
+	if now.Sub(issued) > digestNonceTTL {
+		return digestStale
+	}
+
+	// Replay protection: every use of a nonce must carry a higher count
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state := d.seen[nonce]
+	if nc <= state.lastNC {
+		return digestBad
+	}
+	if len(d.seen) >= digestMaxNonces {
+		for n, s := range d.seen {
+			if now.After(s.expires) {
+				delete(d.seen, n)
+			}
+		}
+		if len(d.seen) >= digestMaxNonces {
+			clear(d.seen)
+		}
+	}
+	d.seen[nonce] = digestNonce{lastNC: nc, expires: issued.Add(digestNonceTTL)}
+	return digestOK
+}
+
+// digestResponse computes the response value of RFC 7616 §3.4.1 for qop=auth
+func digestResponse(newHash func() hash.Hash, sess bool, username, realm, password, nonce, nc, cnonce, method, uri string) string {
+	h := func(s string) string {
+		x := newHash()
+		x.Write([]byte(s))
+		return hex.EncodeToString(x.Sum(nil))
+	}
+	ha1 := h(username + ":" + realm + ":" + password)
+	if sess {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	return h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+}
+
+// digestURIMatches compares the digest uri with the request target. Some clients
+// (curl among them) put the origin form "/path?query" there for absolute-form requests.
+func digestURIMatches(digestURI, requestURI string) bool {
+	if digestURI == requestURI {
+		return true
+	}
+	u, err := url.Parse(requestURI)
+	return err == nil && u.IsAbs() && digestURI == u.RequestURI()
+}
+
+// parseDigestParams splits `k1=v1, k2="v 2"` into a map with lower-case keys
+func parseDigestParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return params
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			// Quoted string with backslash escapes
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			val = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			val = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = val
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"testing"
+	"time"
+)
+
+func TestDigestResponseRFC7616(t *testing.T) {
+	// RFC 7616 §3.9.1
+	const (
+		nonce  = "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+		cnonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+	)
+	tests := []struct {
+		alg     string
+		newHash func() hash.Hash
+		want    string
+	}{
+		{"MD5", md5.New, "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", sha256.New, "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		got := digestResponse(tt.newHash, false, "Mufasa", "http-auth@example.org", "Circle of Life",
+			nonce, "00000001", cnonce, "GET", "/dir/index.html")
+		if got != tt.want {
+			t.Errorf("%s: response %s, want %s", tt.alg, got, tt.want)
+		}
+	}
+}
+
+// digestHeader builds the Proxy-Authorization parameters a client sends for a CONNECT
+func digestHeader(d *digestAuth, alg, password, nonce string, nc int) string {
+	newHash := md5.New
+	if alg == "SHA-256" {
+		newHash = sha256.New
+	}
+	const cnonce, uri = "0a4f113b", "example.com:443"
+	ncs := fmt.Sprintf("%08x", nc)
+	resp := digestResponse(newHash, false, d.username, authRealm, password, nonce, ncs, cnonce, "CONNECT", uri)
+	return fmt.Sprintf(`username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="%s", response="%s", opaque="%s"`,
+		d.username, authRealm, nonce, uri, alg, ncs, cnonce, resp, d.opaque)
+}
+
+func TestDigestVerify(t *testing.T) {
+	d := newDigestAuth("alice", "secret")
+	for _, alg := range []string{"MD5", "SHA-256"} {
+		nonce := d.newNonce()
+		if r := d.verify(digestHeader(d, alg, "secret", nonce, 1), "CONNECT", "example.com:443"); r != digestOK {
+			t.Errorf("%s: got %d, want OK", alg, r)
+		}
+		if r := d.verify(digestHeader(d, alg, "wrong", nonce, 2), "CONNECT", "example.com:443"); r != digestBad {
+			t.Errorf("%s wrong password: got %d, want bad", alg, r)
+		}
+		// Computed for another request target
+		if r := d.verify(digestHeader(d, alg, "secret", nonce, 3), "CONNECT", "example.org:443"); r != digestBad {
+			t.Errorf("%s other uri: got %d, want bad", alg, r)
+		}
+	}
+
+	// A nonce this proxy did not issue
+	forged := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	if r := d.verify(digestHeader(d, "MD5", "secret", forged, 1), "CONNECT", "example.com:443"); r != digestBad {
+		t.Errorf("forged nonce: got %d, want bad", r)
+	}
+}
+
+func TestDigestReplay(t *testing.T) {
+	d := newDigestAuth("alice", "secret")
+	nonce := d.newNonce()
+	verify := func(nc int) digestResult {
+		return d.verify(digestHeader(d, "SHA-256", "secret", nonce, nc), "CONNECT", "example.com:443")
+	}
+
+	if r := verify(1); r != digestOK {
+		t.Fatalf("first use: got %d, want OK", r)
+	}
+	if r := verify(1); r != digestBad {
+		t.Errorf("replayed nc: got %d, want bad", r)
+	}
+	if r := verify(3); r != digestOK {
+		t.Errorf("higher nc: got %d, want OK", r)
+	}
+	if r := verify(2); r != digestBad {
+		t.Errorf("lower nc: got %d, want bad", r)
+	}
+}
+
+func TestDigestStaleNonce(t *testing.T) {
+	d := newDigestAuth("alice", "secret")
+	old := d.nonceAt(time.Now().Add(-digestNonceTTL - time.Minute))
+
+	if r := d.verify(digestHeader(d, "MD5", "secret", old, 1), "CONNECT", "example.com:443"); r != digestStale {
+		t.Errorf("expired nonce: got %d, want stale", r)
+	}
+	// Only a correct response learns that the nonce merely expired
+	if r := d.verify(digestHeader(d, "MD5", "wrong", old, 1), "CONNECT", "example.com:443"); r != digestBad {
+		t.Errorf("expired nonce, wrong password: got %d, want bad", r)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ldapCacheSize bounds the number of cached results
+const ldapCacheSize = 10000
+
+// ldapAuth authenticates users with an LDAP simple bind.
+// The bind DN comes from ldap_user_dn, or from a search under ldap_base_dn
+// with ldap_user_filter (search-then-bind). With ldap_group_dn set the user
+// must also match ldap_group_filter on that group entry.
+type ldapAuth struct {
+	url          string
+	userDN       string // template with {user}; empty means search-then-bind
+	baseDN       string
+	userFilter   string // template with {user}
+	bindDN       string // service account for searches; anonymous when empty
+	bindPassword string
+	groupDN      string
+	groupFilter  string // template with {user} and {dn}
+	timeout      time.Duration
+	positiveTTL  time.Duration
+	negativeTTL  time.Duration
+
+	mu       sync.Mutex
+	cache    map[[sha256.Size]byte]ldapCacheEntry
+	cacheKey []byte
+}
+
+// ldapCacheEntry is a cached bind result
+type ldapCacheEntry struct {
+	allow   bool
+	expires time.Time
+}
+
+// Defaults for the optional LDAP settings
+const (
+	ldapDefaultUserFilter  = "(uid={user})"
+	ldapDefaultGroupFilter = "(|(member={dn})(uniqueMember={dn})(memberUid={user}))"
+)
+
+// newLDAPAuth returns an LDAP backend with the default filters and TTLs
+func newLDAPAuth() *ldapAuth {
+	a := &ldapAuth{
+		userFilter:  ldapDefaultUserFilter,
+		groupFilter: ldapDefaultGroupFilter,
+		timeout:     5 * time.Second,
+		positiveTTL: 5 * time.Minute,
+		negativeTTL: 30 * time.Second,
+		cache:       make(map[[sha256.Size]byte]ldapCacheEntry),
+		cacheKey:    make([]byte, 32),
+	}
+	rand.Read(a.cacheKey)
+	return a
+}
+
+// applyLDAPKey applies one ldap_* setting. It reports false for other keys.
+func applyLDAPKey(a *ldapAuth, key, val string) (bool, error) {
+	switch key {
+	case "ldap_url":
+		if !strings.HasPrefix(val, "ldap://") && !strings.HasPrefix(val, "ldaps://") {
+			return true, fmt.Errorf("ldap_url must start with ldap:// or ldaps://")
+		}
+		a.url = val
+	case "ldap_user_dn":
+		if !strings.Contains(val, "{user}") {
+			return true, fmt.Errorf("ldap_user_dn must contain {user}")
+		}
+		a.userDN = val
+	case "ldap_base_dn":
+		a.baseDN = val
+	case "ldap_user_filter":
+		if _, err := ldapCompileFilter(strings.ReplaceAll(val, "{user}", "x")); err != nil {
+			return true, err
+		}
+		a.userFilter = val
+	case "ldap_bind_dn":
+		a.bindDN = val
+	case "ldap_bind_password":
+		a.bindPassword = val
+	case "ldap_group_dn":
+		a.groupDN = val
+	case "ldap_group_filter":
+		probe := strings.NewReplacer("{user}", "x", "{dn}", "x").Replace(val)
+		if _, err := ldapCompileFilter(probe); err != nil {
+			return true, err
+		}
+		a.groupFilter = val
+	case "ldap_timeout", "ldap_cache_ttl", "ldap_negative_cache_ttl":
+		dur, err := time.ParseDuration(val)
+		if err != nil || dur < 0 {
+			return true, fmt.Errorf("invalid %s %q", key, val)
+		}
+		switch key {
+		case "ldap_timeout":
+			a.timeout = dur
+		case "ldap_cache_ttl":
+			a.positiveTTL = dur
+		default:
+			a.negativeTTL = dur
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// validate checks that the settings describe a usable setup
+func (a *ldapAuth) validate() error {
+	if a.url == "" {
+		return errors.New("auth_backend = ldap needs ldap_url")
+	}
+	if a.userDN == "" && a.baseDN == "" {
+		return errors.New("auth_backend = ldap needs ldap_user_dn or ldap_base_dn")
+	}
+	if a.timeout <= 0 {
+		return errors.New("ldap_timeout must be > 0")
+	}
+	return nil
+}
+
+// authenticate binds as the user, using cached results while they are fresh
+func (a *ldapAuth) authenticate(r *authRequest) (bool, error) {
+	if r.username == "" || r.password == "" {
+		return false, nil
+	}
+
+	h := sha256.New()
+	h.Write(a.cacheKey)
+	h.Write([]byte(r.username))
+	h.Write([]byte{0})
+	h.Write([]byte(r.password))
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	a.mu.Lock()
+	entry, found := a.cache[key]
+	a.mu.Unlock()
+	if found && time.Now().Before(entry.expires) {
+		return entry.allow, nil
+	}
+
+	allow, err := a.check(r.username, r.password)
+	if err != nil {
+		// Server trouble is not an answer about the password; don't cache it
+		logError("LDAP authentication error", "user", r.username, "err", err)
+		return false, err
+	}
+
+	ttl := a.positiveTTL
+	if !allow {
+		ttl = a.negativeTTL
+	}
+	if ttl > 0 {
+		a.mu.Lock()
+		if len(a.cache) >= ldapCacheSize {
+			clear(a.cache)
+		}
+		a.cache[key] = ldapCacheEntry{allow: allow, expires: time.Now().Add(ttl)}
+		a.mu.Unlock()
+	}
+	return allow, nil
+}
+
+// check asks the server. It returns false without an error for wrong
+// credentials, unknown users and users outside the group.
+func (a *ldapAuth) check(username, password string) (bool, error) {
+	conn, err := dialLDAP(a.url, a.timeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.close()
+
+	serviceBind := func() error {
+		if a.bindDN == "" {
+			return nil // anonymous
+		}
+		return conn.bind(a.bindDN, a.bindPassword)
+	}
+
+	userDN := strings.ReplaceAll(a.userDN, "{user}", ldapEscapeDN(username))
+	if a.userDN == "" {
+		if err := serviceBind(); err != nil {
+			return false, fmt.Errorf("service bind: %v", err)
+		}
+		filter := strings.ReplaceAll(a.userFilter, "{user}", ldapEscapeFilter(username))
+		dns, err := conn.search(a.baseDN, ldapScopeSubtree, filter, 2)
+		if err != nil {
+			return false, err
+		}
+		if len(dns) != 1 {
+			// Unknown or ambiguous user
+			return false, nil
+		}
+		userDN = dns[0]
+	}
+
+	if err := conn.bind(userDN, password); err != nil {
+		if errors.Is(err, errLDAPInvalidCredentials) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if a.groupDN == "" {
+		return true, nil
+	}
+	// Group lookups run as the service account when there is one
+	if a.bindDN != "" {
+		if err := serviceBind(); err != nil {
+			return false, fmt.Errorf("service bind: %v", err)
+		}
+	}
+	filter := strings.NewReplacer("{user}", ldapEscapeFilter(username), "{dn}", ldapEscapeFilter(userDN)).Replace(a.groupFilter)
+	dns, err := conn.search(a.groupDN, ldapScopeBase, filter, 1)
+	if err != nil {
+		return false, err
+	}
+	return len(dns) > 0, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ldapStandIn is a tiny in-process LDAP server: simple binds against a fixed
+// directory and searches that match uid= equality filters exactly. Any other
+// filter matches every entry, so an injected wildcard would find a user.
+type ldapStandIn struct {
+	url       string
+	directory map[string]string // DN -> password
+
+	mu      sync.Mutex
+	binds   []string     // DNs bound as
+	filters []berElement // filters searched for
+}
+
+func startLDAPStandIn(t *testing.T, directory map[string]string) *ldapStandIn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &ldapStandIn{url: "ldap://" + ln.Addr().String(), directory: directory}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *ldapStandIn) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		msg, err := berReadMessage(r)
+		if err != nil || len(msg.children) < 2 {
+			return
+		}
+		id := berInt(berInteger, berToInt(msg.children[0].content))
+		op := msg.children[1]
+		reply := func(resp []byte) { c.Write(berConstructed(berSequence, id, resp)) }
+		result := func(tag byte, code int) []byte {
+			return berConstructed(tag, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, ""))
+		}
+
+		switch op.tag {
+		case ldapBindRequest:
+			dn, password := string(op.children[1].content), string(op.children[2].content)
+			s.mu.Lock()
+			s.binds = append(s.binds, dn)
+			s.mu.Unlock()
+			// Like real servers, an empty password is an unauthenticated bind and succeeds
+			code := ldapInvalidCredentials
+			if want, ok := s.directory[dn]; password == "" || (ok && want == password) {
+				code = ldapSuccess
+			}
+			reply(result(ldapBindResponse, code))
+		case ldapSearchRequest:
+			filter := op.children[6]
+			s.mu.Lock()
+			s.filters = append(s.filters, filter)
+			s.mu.Unlock()
+			for dn := range s.directory {
+				if s.matches(filter, dn) {
+					reply(berConstructed(ldapSearchEntry, berString(berOctetString, dn), berConstructed(berSequence)))
+				}
+			}
+			reply(result(ldapSearchDone, ldapSuccess))
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *ldapStandIn) matches(filter berElement, dn string) bool {
+	if filter.tag != 0xa3 {
+		return true
+	}
+	attr, value := string(filter.children[0].content), string(filter.children[1].content)
+	return attr == "uid" && strings.HasPrefix(dn, "uid="+value+",")
+}
+
+func (s *ldapStandIn) boundAs(dn string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.binds {
+		if b == dn {
+			return true
+		}
+	}
+	return false
+}
+
+const aliceDN = "uid=alice,ou=people,dc=example,dc=org"
+
+func newTestLDAP(t *testing.T, searchThenBind bool) (*ldapAuth, *ldapStandIn) {
+	s := startLDAPStandIn(t, map[string]string{aliceDN: "secret"})
+	a := newLDAPAuth()
+	a.url = s.url
+	a.timeout = 2 * time.Second
+	if searchThenBind {
+		a.baseDN = "ou=people,dc=example,dc=org"
+	} else {
+		a.userDN = "uid={user},ou=people,dc=example,dc=org"
+	}
+	return a, s
+}
+
+func TestLDAPBind(t *testing.T) {
+	for _, search := range []bool{false, true} {
+		a, s := newTestLDAP(t, search)
+
+		if ok, err := a.authenticate(loginAs("alice", "secret")); !ok || err != nil {
+			t.Errorf("search=%v: alice got (%v, %v), want allowed", search, ok, err)
+		}
+		if !s.boundAs(aliceDN) {
+			t.Errorf("search=%v: never bound as %s", search, aliceDN)
+		}
+		if ok, err := a.authenticate(loginAs("alice", "wrong")); ok || err != nil {
+			t.Errorf("search=%v: wrong password got (%v, %v), want denied", search, ok, err)
+		}
+		if ok, err := a.authenticate(loginAs("bob", "secret")); ok || err != nil {
+			t.Errorf("search=%v: unknown user got (%v, %v), want denied", search, ok, err)
+		}
+	}
+}
+
+func TestLDAPEmptyPassword(t *testing.T) {
+	for _, search := range []bool{false, true} {
+		a, s := newTestLDAP(t, search)
+
+		if ok, err := a.authenticate(loginAs("alice", "")); ok || err != nil {
+			t.Errorf("search=%v: authenticate got (%v, %v), want denied", search, ok, err)
+		}
+		// Even past authenticate, the bind itself must not become an unauthenticated bind
+		if ok, err := a.check("alice", ""); ok || err != nil {
+			t.Errorf("search=%v: check got (%v, %v), want denied", search, ok, err)
+		}
+		if s.boundAs(aliceDN) {
+			t.Errorf("search=%v: sent a bind with an empty password", search)
+		}
+	}
+}
+
+func TestLDAPFilterMetacharacters(t *testing.T) {
+	a, s := newTestLDAP(t, true)
+
+	for _, name := range []string{"*", "ali*", "alice)(uid=*", "*)(|(uid=*", `alice\2a`, "alice\x00"} {
+		if ok, err := a.check(name, "secret"); ok || err != nil {
+			t.Errorf("%q: got (%v, %v), want denied", name, ok, err)
+		}
+	}
+
+	// Every search arrived as one equality match on the literal name
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.filters {
+		if f.tag != 0xa3 || len(f.children) != 2 || string(f.children[0].content) != "uid" {
+			t.Errorf("filter was rewritten: tag %#x", f.tag)
+		}
+	}
+	if len(s.filters) != 6 {
+		t.Errorf("%d searches, want 6", len(s.filters))
+	}
+}
+
+func TestLDAPDNMetacharacters(t *testing.T) {
+	a, s := newTestLDAP(t, false)
+
+	// The separators stay part of the uid value instead of adding RDNs
+	if ok, err := a.check("alice,ou=admins", "secret"); ok || err != nil {
+		t.Errorf("got (%v, %v), want denied", ok, err)
+	}
+	if want := `uid=alice\,ou\=admins,ou=people,dc=example,dc=org`; !s.boundAs(want) {
+		t.Errorf("never bound as %q", want)
+	}
+}
+
+func TestLDAPUnreachable(t *testing.T) {
+	a, _ := newTestLDAP(t, false)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.url = "ldap://" + ln.Addr().String()
+	ln.Close()
+
+	if ok, err := a.authenticate(loginAs("alice", "secret")); ok || err == nil {
+		t.Errorf("got (%v, %v), want an error", ok, err)
+	}
+}
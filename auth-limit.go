@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Brute-force protection: failed logins are counted per client IP and per
+// username. Every failure delays the answer a little longer, and reaching the
+// limit bans the IP or username for a while; repeated bans get longer.
+
+const (
+	authMaxFailureDelay = 5 * time.Second // cap of the per-failure delay
+	authLimitMaxEntries = 100000          // bound on each counter table
+)
+
+// authLimiter keeps the failure counters and bans
+type authLimiter struct {
+	maxIPFailures   int           // auth_max_failures; 0 disables IP bans
+	maxUserFailures int           // auth_max_user_failures; 0 disables user bans
+	window          time.Duration // auth_failure_window
+	delay           time.Duration // auth_failure_delay, doubled for every further failure
+	banTime         time.Duration // auth_ban_time, doubled for every further ban
+	maxBanTime      time.Duration // auth_max_ban_time
+
+	// time.Now and time.Sleep, replaced by a fake clock in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	mu    sync.Mutex
+	ips   map[string]*failureRecord
+	users map[string]*failureRecord
+}
+
+// failureRecord tracks one IP address or username
+type failureRecord struct {
+	failures    int       // failures in the current window
+	firstFail   time.Time // start of the current window
+	lastFail    time.Time
+	bans        int // bans so far; the next one lasts banTime << bans
+	bannedUntil time.Time
+}
+
+// newAuthLimiter returns the limiter with its default settings. Counting is off
+// until auth_max_failures or auth_max_user_failures is set.
+func newAuthLimiter() *authLimiter {
+	return &authLimiter{
+		maxIPFailures:   0,
+		maxUserFailures: 0,
+		window:          10 * time.Minute,
+		delay:           200 * time.Millisecond,
+		banTime:         time.Minute,
+		maxBanTime:      time.Hour,
+		now:             time.Now,
+		sleep:           time.Sleep,
+		ips:             make(map[string]*failureRecord),
+		users:           make(map[string]*failureRecord),
+	}
+}
+
+// applyAuthLimitKey applies one brute-force protection setting. It reports false for other keys.
+func applyAuthLimitKey(a *authLimiter, key, val string) (bool, error) {
+	switch key {
+	case "auth_max_failures", "auth_max_user_failures":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return true, fmt.Errorf("invalid %s %q", key, val)
+		}
+		if key == "auth_max_failures" {
+			a.maxIPFailures = n
+		} else {
+			a.maxUserFailures = n
+		}
+	case "auth_failure_window", "auth_failure_delay", "auth_ban_time", "auth_max_ban_time":
+		dur, err := time.ParseDuration(val)
+		if err != nil || dur < 0 || (dur == 0 && key != "auth_failure_delay") {
+			return true, fmt.Errorf("invalid %s %q", key, val)
+		}
+		switch key {
+		case "auth_failure_window":
+			a.window = dur
+		case "auth_failure_delay":
+			a.delay = dur
+		case "auth_ban_time":
+			a.banTime = dur
+		default:
+			a.maxBanTime = dur
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// ipBanned reports whether logins from ip are refused, and until when
+func (a *authLimiter) ipBanned(ip net.IP) (time.Time, bool) {
+	if a.maxIPFailures == 0 || ip == nil {
+		return time.Time{}, false
+	}
+	return a.banned(a.ips, ip.String())
+}
+
+// userBanned reports whether logins as user are refused, and until when
+func (a *authLimiter) userBanned(user string) (time.Time, bool) {
+	if a.maxUserFailures == 0 || user == "" {
+		return time.Time{}, false
+	}
+	return a.banned(a.users, user)
+}
+
+// banned looks up a ban in one of the tables
+func (a *authLimiter) banned(table map[string]*failureRecord, key string) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if r := table[key]; r != nil && a.now().Before(r.bannedUntil) {
+		return r.bannedUntil, true
+	}
+	return time.Time{}, false
+}
+
+// allowed reports whether a login attempt may be checked at all.
+// user may be "" when the client did not send a username.
+func (a *authLimiter) allowed(ip net.IP, user string) bool {
+	if _, banned := a.ipBanned(ip); banned {
+		return false
+	}
+	_, banned := a.userBanned(user)
+	return !banned
+}
+
+// failed counts a failed login over proto and waits out the backoff delay
+// before the caller answers the client
+func (a *authLimiter) failed(ip net.IP, user, proto string) {
+	now := a.now()
+	failures := 0
+	var bans [][]any // log fields of the bans imposed
+
+	a.mu.Lock()
+	if a.maxIPFailures > 0 && ip != nil {
+		if n, ban := a.record(a.ips, ip.String(), a.maxIPFailures, now); ban > 0 {
+			bans = append(bans, []any{"proto", proto, "client", ip, "failures", n, "ban", ban})
+			metrics.bans.inc("ip")
+		} else {
+			failures = max(failures, n)
+		}
+	}
+	if a.maxUserFailures > 0 && user != "" {
+		if n, ban := a.record(a.users, user, a.maxUserFailures, now); ban > 0 {
+			bans = append(bans, []any{"proto", proto, "user", user, "failures", n, "ban", ban})
+			metrics.bans.inc("user")
+		} else {
+			failures = max(failures, n)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, fields := range bans {
+		logWarn("banned after failed logins", fields...)
+	}
+
+	if a.delay > 0 && failures > 0 {
+		a.sleep(backoff(a.delay, failures-1, authMaxFailureDelay))
+	}
+}
+
+// record adds a failure to one table entry. It returns the failures counted
+// in the window and the length of the ban that was just imposed, if any.
+func (a *authLimiter) record(table map[string]*failureRecord, key string, limit int, now time.Time) (int, time.Duration) {
+	r := table[key]
+	if r == nil {
+		if len(table) >= authLimitMaxEntries {
+			a.prune(table, now)
+		}
+		r = &failureRecord{}
+		table[key] = r
+	}
+	if now.Sub(r.firstFail) > a.window {
+		r.failures, r.firstFail = 0, now
+	}
+	r.failures++
+	r.lastFail = now
+	if r.failures < limit {
+		return r.failures, 0
+	}
+
+	n := r.failures
+	ban := backoff(a.banTime, r.bans, a.maxBanTime)
+	r.bans++
+	r.failures = 0
+	r.bannedUntil = now.Add(ban)
+	return n, ban
+}
+
+// succeeded clears the failure counters after a good login; earlier bans
+// still count towards the length of the next one
+func (a *authLimiter) succeeded(ip net.IP, user string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ip != nil {
+		if r := a.ips[ip.String()]; r != nil {
+			r.failures = 0
+		}
+	}
+	if r := a.users[user]; r != nil {
+		r.failures = 0
+	}
+}
+
+// prune drops entries that are neither banned nor recently active, and
+// everything if the table is still full
+func (a *authLimiter) prune(table map[string]*failureRecord, now time.Time) {
+	forget := max(a.window, a.maxBanTime)
+	for key, r := range table {
+		if now.After(r.bannedUntil) && now.Sub(r.lastFail) > forget {
+			delete(table, key)
+		}
+	}
+	if len(table) >= authLimitMaxEntries {
+		clear(table)
+	}
+}
+
+// activeBans counts the IP addresses and usernames banned right now
+func (a *authLimiter) activeBans() (ips, users int) {
+	now := a.now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range a.ips {
+		if now.Before(r.bannedUntil) {
+			ips++
+		}
+	}
+	for _, r := range a.users {
+		if now.Before(r.bannedUntil) {
+			users++
+		}
+	}
+	return ips, users
+}
+
+// backoff returns base doubled n times, capped at limit
+func backoff(base time.Duration, n int, limit time.Duration) time.Duration {
+	d := base
+	for ; n > 0 && d < limit; n-- {
+		d *= 2
+	}
+	return min(d, limit)
+}
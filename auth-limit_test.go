@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeClock drives an authLimiter's clock and records its backoff sleeps
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func newTestLimiter(ipLimit, userLimit int) (*authLimiter, *fakeClock) {
+	c := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := newAuthLimiter()
+	a.maxIPFailures, a.maxUserFailures = ipLimit, userLimit
+	a.now = func() time.Time { return c.now }
+	a.sleep = func(d time.Duration) { c.sleeps = append(c.sleeps, d) }
+	return a, c
+}
+
+var testClientIP = net.ParseIP("10.0.0.5")
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		base, limit time.Duration
+		n           int
+		want        time.Duration
+	}{
+		{time.Second, time.Minute, 0, time.Second},
+		{time.Second, time.Minute, 1, 2 * time.Second},
+		{time.Second, time.Minute, 5, 32 * time.Second},
+		{time.Second, time.Minute, 6, time.Minute},
+		{time.Second, time.Minute, 1000, time.Minute},
+		{time.Minute, time.Second, 0, time.Second},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.base, tt.n, tt.limit); got != tt.want {
+			t.Errorf("backoff(%v, %d, %v) = %v, want %v", tt.base, tt.n, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestAuthFailureDelay(t *testing.T) {
+	a, c := newTestLimiter(100, 0)
+	a.delay = time.Second
+
+	for range 6 {
+		a.failed(testClientIP, "alice", "http")
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, authMaxFailureDelay, authMaxFailureDelay, authMaxFailureDelay}
+	if len(c.sleeps) != len(want) {
+		t.Fatalf("slept %v, want %v", c.sleeps, want)
+	}
+	for i := range want {
+		if c.sleeps[i] != want[i] {
+			t.Fatalf("slept %v, want %v", c.sleeps, want)
+		}
+	}
+}
+
+func TestAuthFailureWindow(t *testing.T) {
+	a, c := newTestLimiter(3, 0)
+
+	a.failed(testClientIP, "", "http")
+	a.failed(testClientIP, "", "http")
+	// The window has passed, so counting starts over
+	c.now = c.now.Add(a.window + time.Second)
+	a.failed(testClientIP, "", "http")
+	a.failed(testClientIP, "", "http")
+	if !a.allowed(testClientIP, "") {
+		t.Fatal("banned after failures spread over two windows")
+	}
+
+	a.failed(testClientIP, "", "http")
+	if a.allowed(testClientIP, "") {
+		t.Fatal("not banned after three failures within the window")
+	}
+	if ips, users := a.activeBans(); ips != 1 || users != 0 {
+		t.Errorf("active bans (%d, %d), want (1, 0)", ips, users)
+	}
+}
+
+func TestAuthBanEscalation(t *testing.T) {
+	a, c := newTestLimiter(0, 2)
+	a.banTime, a.maxBanTime = time.Minute, 5*time.Minute
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		a.failed(testClientIP, "alice", "socks5")
+		a.failed(testClientIP, "alice", "socks5")
+		until, banned := a.userBanned("alice")
+		if !banned || until.Sub(c.now) != want {
+			t.Fatalf("ban until %v (%v), want %v from now", until, banned, want)
+		}
+		if a.allowed(net.ParseIP("10.0.0.6"), "alice") {
+			t.Fatal("banned user allowed from another address")
+		}
+
+		c.now = until.Add(time.Second)
+		if !a.allowed(testClientIP, "alice") {
+			t.Fatal("still banned after the ban ended")
+		}
+	}
+	if _, banned := a.ipBanned(testClientIP); banned {
+		t.Error("IP banned with auth_max_failures off")
+	}
+}
+
+func TestAuthSuccessResets(t *testing.T) {
+	a, c := newTestLimiter(3, 0)
+	a.banTime, a.maxBanTime = time.Minute, time.Hour
+
+	a.failed(testClientIP, "alice", "http")
+	a.failed(testClientIP, "alice", "http")
+	a.succeeded(testClientIP, "alice")
+	a.failed(testClientIP, "alice", "http")
+	a.failed(testClientIP, "alice", "http")
+	if !a.allowed(testClientIP, "alice") {
+		t.Fatal("failures before a good login still counted")
+	}
+
+	// A good login clears the count but not the history of bans
+	a.failed(testClientIP, "alice", "http")
+	until, _ := a.ipBanned(testClientIP)
+	c.now = until.Add(time.Second)
+	a.succeeded(testClientIP, "alice")
+	for range 3 {
+		a.failed(testClientIP, "alice", "http")
+	}
+	if until, banned := a.ipBanned(testClientIP); !banned || until.Sub(c.now) != 2*time.Minute {
+		t.Errorf("second ban until %v (%v), want 2m from now", until, banned)
+	}
+}
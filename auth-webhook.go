@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookCacheSize bounds the number of cached answers
+const webhookCacheSize = 10000
+
+// webhookAuth asks an external HTTP service whether a login is allowed.
+// The service receives a JSON body and answers 200 to allow or 401/403 to deny;
+// anything else is treated as an outage and denies without being cached.
+type webhookAuth struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]webhookAnswer
+}
+
+// webhookAnswer is a cached allow/deny decision
+type webhookAnswer struct {
+	allow   bool
+	expires time.Time
+}
+
+// webhookRequest is the JSON body sent to the service
+type webhookRequest struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	ClientIP    string `json:"client_ip"`
+	Destination string `json:"destination"` // host:port, "" for SOCKS5 logins
+	Protocol    string `json:"protocol"`    // http, socks4 or socks5
+}
+
+// newWebhookAuth creates the webhook backend
+func newWebhookAuth(url string, timeout, ttl time.Duration) *webhookAuth {
+	return &webhookAuth{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: timeout},
+		cache:  make(map[[sha256.Size]byte]webhookAnswer),
+	}
+}
+
+// authenticate returns the cached answer for this exact login or asks the service
+func (w *webhookAuth) authenticate(r *authRequest) (bool, error) {
+	body := webhookRequest{
+		Username:    r.username,
+		Password:    r.password,
+		Destination: r.destination,
+		Protocol:    r.protocol,
+	}
+	if r.clientIP != nil {
+		body.ClientIP = r.clientIP.String()
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+	// The whole request is the cache key; only its hash is kept in memory
+	key := sha256.Sum256(payload)
+
+	w.mu.Lock()
+	answer, found := w.cache[key]
+	w.mu.Unlock()
+	if found && time.Now().Before(answer.expires) {
+		return answer.allow, nil
+	}
+
+	allow, err := w.ask(payload)
+	if err != nil {
+		logError("auth webhook error", "user", r.username, "err", err)
+		return false, err
+	}
+
+	w.mu.Lock()
+	if len(w.cache) >= webhookCacheSize {
+		clear(w.cache)
+	}
+	w.cache[key] = webhookAnswer{allow: allow, expires: time.Now().Add(w.ttl)}
+	w.mu.Unlock()
+	return allow, nil
+}
+
+// webhookAllowsDestination asks the webhook about a SOCKS5 login again once the
+// client has named its destination; at login time the destination is empty.
+// Other backends have no per-destination policy.
+func webhookAllowsDestination(l *ListenerConfig, login *authRequest, destination string) bool {
+	if l.AuthBackend != "webhook" {
+		return true
+	}
+	r := *login
+	r.destination = destination
+	ok, err := cfg.webhook.authenticate(&r)
+	if !ok && err == nil {
+		logWarn("destination refused by auth webhook", "proto", r.protocol, "user", r.username, "client", r.clientIP, "dest", destination)
+	}
+	return ok
+}
+
+// ask posts one request to the service
+func (w *webhookAuth) ask(payload []byte) (bool, error) {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return true, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status %s", resp.Status)
+}
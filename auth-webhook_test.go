@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookServer answers logins for alice/secret and counts the calls
+func webhookServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func aliceHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad body: %v", err)
+		}
+		if req.ClientIP != "10.0.0.5" || req.Protocol != "http" || req.Destination == "" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		if req.Username == "alice" && req.Password == "secret" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
+
+func loginAs(user, password string) *authRequest {
+	return &authRequest{
+		username:    user,
+		password:    password,
+		clientIP:    net.ParseIP("10.0.0.5"),
+		destination: "example.com:443",
+		protocol:    "http",
+	}
+}
+
+func TestWebhookAllowDeny(t *testing.T) {
+	srv, _ := webhookServer(t, aliceHandler(t))
+	w := newWebhookAuth(srv.URL, time.Second, time.Minute)
+
+	if ok, err := w.authenticate(loginAs("alice", "secret")); !ok || err != nil {
+		t.Errorf("alice: got (%v, %v), want allowed", ok, err)
+	}
+	if ok, err := w.authenticate(loginAs("alice", "wrong")); ok || err != nil {
+		t.Errorf("wrong password: got (%v, %v), want denied", ok, err)
+	}
+	if ok, err := w.authenticate(loginAs("bob", "secret")); ok || err != nil {
+		t.Errorf("bob: got (%v, %v), want denied", ok, err)
+	}
+}
+
+func TestWebhookUnexpectedStatus(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusFound, http.StatusTooManyRequests} {
+		srv, calls := webhookServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+		w := newWebhookAuth(srv.URL, time.Second, time.Minute)
+
+		for range 2 {
+			if ok, err := w.authenticate(loginAs("alice", "secret")); ok || err == nil {
+				t.Errorf("status %d: got (%v, %v), want an error", status, ok, err)
+			}
+		}
+		// Outages are not cached
+		if n := calls.Load(); n != 2 {
+			t.Errorf("status %d: %d calls, want 2", status, n)
+		}
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv, _ := webhookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer close(release)
+	w := newWebhookAuth(srv.URL, 50*time.Millisecond, time.Minute)
+
+	start := time.Now()
+	ok, err := w.authenticate(loginAs("alice", "secret"))
+	if ok || err == nil {
+		t.Errorf("got (%v, %v), want a timeout error", ok, err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("took %v despite the 50ms timeout", d)
+	}
+}
+
+func TestWebhookUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	w := newWebhookAuth(url, time.Second, time.Minute)
+	if ok, err := w.authenticate(loginAs("alice", "secret")); ok || err == nil {
+		t.Errorf("got (%v, %v), want an error", ok, err)
+	}
+}
+
+func TestWebhookCache(t *testing.T) {
+	srv, calls := webhookServer(t, aliceHandler(t))
+	w := newWebhookAuth(srv.URL, time.Second, 100*time.Millisecond)
+
+	for range 3 {
+		w.authenticate(loginAs("alice", "secret"))
+		w.authenticate(loginAs("alice", "wrong"))
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("%d calls within the TTL, want 2", n)
+	}
+
+	// A different destination is a different request
+	r := loginAs("alice", "secret")
+	r.destination = "example.org:443"
+	w.authenticate(r)
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("%d calls after a new destination, want 3", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if ok, _ := w.authenticate(loginAs("alice", "secret")); !ok {
+		t.Error("alice denied after the cache expired")
+	}
+	if n := calls.Load(); n != 4 {
+		t.Errorf("%d calls after the TTL, want 4", n)
+	}
+}
+
+// socks5Connect logs in as alice and asks for a CONNECT to target, returning the reply code
+func socks5Connect(t *testing.T, l *ListenerConfig, target *net.TCPAddr) byte {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go handleSocks(server, l, &connInfo{})
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	req := []byte{0x05, 0x01, 0x02, 0x01, 5}
+	req = append(append(req, "alice"...), 6)
+	req = append(append(req, "secret"...), 0x05, 0x01, 0x00)
+	client.Write(appendSocksAddr(req, target.IP, target.Port))
+
+	var reply [2 + 2 + 10]byte
+	if _, err := io.ReadFull(client, reply[:]); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x02 || reply[3] != 0x00 {
+		t.Fatalf("login failed: %x", reply[:4])
+	}
+	return reply[5]
+}
+
+func TestWebhookSocks5Destination(t *testing.T) {
+	allowed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+	denied := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+
+	var mu sync.Mutex
+	var destinations []string
+	srv, _ := webhookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var req webhookRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		destinations = append(destinations, req.Destination)
+		mu.Unlock()
+		// The login itself has no destination yet
+		if req.Destination == "" || req.Destination == allowed.Addr().String() {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	})
+	defer func(w *webhookAuth) { cfg.webhook = w }(cfg.webhook)
+	cfg.webhook = newWebhookAuth(srv.URL, time.Second, time.Minute)
+	l := &ListenerConfig{AuthRequired: true, AuthBackend: "webhook", authBackends: []authBackend{cfg.webhook}}
+
+	if rep := socks5Connect(t, l, allowed.Addr().(*net.TCPAddr)); rep != 0x00 {
+		t.Errorf("allowed destination: reply %#x, want success", rep)
+	}
+	if rep := socks5Connect(t, l, denied); rep != 0x02 {
+		t.Errorf("denied destination: reply %#x, want not allowed", rep)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(destinations) != 3 || destinations[0] != "" || destinations[2] != denied.String() {
+		t.Errorf("webhook asked about %q", destinations)
+	}
+}
@@ -2,69 +2,198 @@ package main
 
 import (
 	"crypto/subtle"
+	"encoding/base64"
 	"io"
 	"net"
+	"strings"
 )
 
-// validateAuth validates HTTP Basic Authentication header value
-func validateAuth(authHeader string) bool {
-	if !cfg.AuthRequired {
-		return true
+// authRequest is one login attempt
+type authRequest struct {
+	username    string
+	password    string
+	clientIP    net.IP
+	destination string // host:port the client asked for, "" if not known yet
+	protocol    string // http, socks4 or socks5
+}
+
+// authBackend verifies a login attempt
+type authBackend interface {
+	// authenticate returns false with a nil error when the credentials are
+	// rejected, and an error when the backend could not give an answer
+	authenticate(r *authRequest) (bool, error)
+}
+
+// staticAuth is the single auth_user / auth_pass account
+type staticAuth struct {
+	username string
+	password string
+}
+
+// authenticate compares both fields in constant time
+func (s staticAuth) authenticate(r *authRequest) (bool, error) {
+	userOK := subtle.ConstantTimeCompare([]byte(r.username), []byte(s.username))
+	passOK := subtle.ConstantTimeCompare([]byte(r.password), []byte(s.password))
+	return userOK&passOK == 1, nil
+}
+
+// validateAuth validates the Proxy-Authorization header value of an HTTP request.
+// method and requestURI are covered by Digest responses; destination is the
+// host:port of the request, for backends that decide per destination.
+// A verified TLS client certificate logs the user in without a header.
+// It returns the authenticated username ("" when auth is not required) and
+// stale = true for a valid Digest response to an expired nonce.
+func validateAuth(l *ListenerConfig, authHeader string, client net.Conn, method, requestURI, destination string) (user string, ok, stale bool) {
+	if !l.AuthRequired {
+		return "", true, false
+	}
+	if user := clientCertUser(l, client); user != "" {
+		return user, true, false
+	}
+	if authHeader == "" {
+		// No credentials yet; the 407 challenge asks for them
+		return "", false, false
+	}
+	ip := remoteIP(client)
+
+	scheme, token, _ := strings.Cut(authHeader, " ")
+	if l.digest != nil && strings.EqualFold(scheme, "Digest") {
+		// Failures count against the name the client sent, so bogus responses
+		// can't lock out the configured account
+		username := parseDigestParams(token)["username"]
+		if !cfg.authLimit.allowed(ip, username) {
+			return "", false, false
+		}
+		switch l.digest.verify(token, method, requestURI) {
+		case digestOK:
+			cfg.authLimit.succeeded(ip, username)
+			return l.AuthUsername, true, false
+		case digestStale:
+			return "", false, true
+		}
+		cfg.authLimit.failed(ip, username, "http")
+		return "", false, false
+	}
+	if l.AuthScheme == authSchemeDigest {
+		// Basic credentials travel in clear text; the listener only takes Digest
+		return "", false, false
 	}
 
 	// Direct byte comparison with pre-computed token
-	if subtle.ConstantTimeCompare([]byte(authHeader), cfg.AuthBasicToken) == 1 {
-		return true
+	if l.AuthBasicToken != nil && subtle.ConstantTimeCompare([]byte(authHeader), l.AuthBasicToken) == 1 {
+		if !cfg.authLimit.allowed(ip, l.AuthUsername) {
+			return "", false, false
+		}
+		cfg.authLimit.succeeded(ip, l.AuthUsername)
+		return l.AuthUsername, true, false
 	}
 
-	return false
+	// Otherwise decode the credentials for the other backends
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", false, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return "", false, false
+	}
+	username, password, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return "", false, false
+	}
+	r := &authRequest{username: username, password: password, clientIP: ip, destination: destination, protocol: "http"}
+	if !checkCredentials(l, r) {
+		return "", false, false
+	}
+	return username, true, false
+}
+
+// authChallenge returns the Proxy-Authenticate header lines of a 407 response
+func authChallenge(l *ListenerConfig, stale bool) string {
+	var challenge string
+	if l.digest != nil {
+		challenge = l.digest.challenges(stale)
+	}
+	if l.AuthScheme != authSchemeDigest {
+		challenge += "Proxy-Authenticate: Basic realm=\"" + authRealm + "\"\r\n"
+	}
+	return challenge
 }
 
 // authenticateSocks performs SOCKS5 username/password authentication (RFC 1929)
-func authenticateSocks(client net.Conn) bool {
+// and returns the login, which a webhook is asked about again once the client
+// names its destination. A successful login holds a connection
+// slot of the user's policy until the caller releases it. When the credentials
+// are right but the user's policy refuses the login, refusal says why; such a
+// refusal is not a failed login.
+func authenticateSocks(client net.Conn, l *ListenerConfig) (login *authRequest, refusal string, ok bool) {
 	var buf [256]byte
 
 	// Read version, username length
 	if _, err := io.ReadFull(client, buf[:2]); err != nil {
-		return false
+		return nil, "", false
 	}
 	version, ulen := buf[0], buf[1]
 
 	if version != 0x01 || ulen > 255 {
-		return false
+		return nil, "", false
 	}
 
 	// Read username
 	if _, err := io.ReadFull(client, buf[:ulen]); err != nil {
-		return false
+		return nil, "", false
 	}
 	username := string(buf[:ulen])
 
 	// Read password length
 	if _, err := io.ReadFull(client, buf[:1]); err != nil {
-		return false
+		return nil, "", false
 	}
 	plen := buf[0]
 
 	if plen > 255 {
-		return false
+		return nil, "", false
 	}
 
 	// Read password
 	if _, err := io.ReadFull(client, buf[:plen]); err != nil {
-		return false
+		return nil, "", false
 	}
 	password := string(buf[:plen])
 
-	// Verify credentials using constant-time comparison
-	if subtle.ConstantTimeCompare([]byte(username), []byte(cfg.AuthUsername)) == 1 &&
-		subtle.ConstantTimeCompare([]byte(password), []byte(cfg.AuthPassword)) == 1 {
-		// Success
-		client.Write([]byte{0x01, 0x00})
-		return true
+	r := &authRequest{username: username, password: password, clientIP: remoteIP(client), protocol: "socks5"}
+	if !checkCredentials(l, r) {
+		client.Write([]byte{0x01, 0x01})
+		return nil, "", false
+	}
+	if refusal = socksRefusal(client, username); refusal != "" {
+		client.Write([]byte{0x01, 0x01})
+		return r, refusal, false
 	}
 
-	// Failure
-	client.Write([]byte{0x01, 0x01})
+	client.Write([]byte{0x01, 0x00})
+	return r, "", true
+}
+
+// checkCredentials verifies a login attempt against the listener's backends.
+// Banned clients and usernames fail without reaching the backends. Only a
+// rejection counts towards a ban; a backend that is down doesn't.
+func checkCredentials(l *ListenerConfig, r *authRequest) bool {
+	if !cfg.authLimit.allowed(r.clientIP, r.username) {
+		return false
+	}
+	unavailable := false
+	for _, b := range l.authBackends {
+		ok, err := b.authenticate(r)
+		if ok {
+			cfg.authLimit.succeeded(r.clientIP, r.username)
+			return true
+		}
+		if err != nil {
+			unavailable = true
+		}
+	}
+	if !unavailable {
+		cfg.authLimit.failed(r.clientIP, r.username, r.protocol)
+	}
 	return false
 }
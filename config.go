@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -11,17 +13,113 @@ import (
 
 // Config holds all configuration options
 type Config struct {
-	Port         int
-	isSocks      bool
-	isDebug      bool
-	isLogOff     bool
-	AllowedIPs   []string
-	IdleTimeout  time.Duration
-	BufferSize   int
-	AuthUsername string
-	AuthPassword string
-	AuthRequired bool   // Computed flag to avoid repeated string comparisons
+	LogLevel    logLevel
+	IdleTimeout time.Duration
+	BufferSize  int
+	Listeners   []*ListenerConfig
+
+	// Outbound connections go through this dialer (upstream_proxy)
+	// unless a route rule picks another one
+	Upstream  Dialer
+	Upstreams map[string]Dialer // named upstreams for route rules
+	Routes    []*routeRule
+
+	// Destination ACL (dest_rule / dest_default)
+	DestRules        []*aclRule
+	DestDefaultAllow bool
+
+	// Per-user policies ([user <name>] sections)
+	Users         map[string]*userPolicy
+	userDestRules bool // some user has dest_rule or dest_default
+
+	// SSRF protection (block_private_destinations / private_destination_allow)
+	BlockPrivate bool
+	PrivateAllow []*net.IPNet
+
+	// HTTP forward path headers
+	AddVia           bool
+	AddForwarded     bool
+	AddXForwardedFor bool
+
+	// Prometheus endpoint (metrics_listen), off when empty
+	MetricsListen string
+
+	// Admin API (admin_listen), off when empty; loopback addresses only
+	AdminListen string
+
+	// Access log (access_log): a file path or "stdout", off when empty
+	AccessLog       string
+	AccessLogFormat string // access_log_format
+
+	// External auth backends
+	WebhookURL     string        // auth_webhook_url
+	WebhookTimeout time.Duration // auth_webhook_timeout
+	WebhookTTL     time.Duration // auth_webhook_ttl
+
+	authFiles map[string]*htpasswdFile // auth_file databases by path
+	certs     map[string]*certReloader // tls_cert / tls_key pairs in use
+	webhook   *webhookAuth             // shared by listeners with auth_backend = webhook
+	ldap      *ldapAuth                // ldap_* settings, shared by listeners with auth_backend = ldap
+
+	authLimit *authLimiter // failed-login counters and bans (auth_max_failures etc.)
+}
+
+// Listener protocol modes
+const (
+	modeHTTP  = iota // proxy_mode = http
+	modeSocks        // proxy_mode = socks
+	modeAuto         // proxy_mode = auto (detected from the first byte)
+)
+
+// ListenerConfig holds the options of a single listener.
+// Keys set outside any [listener] block act as defaults for every block.
+type ListenerConfig struct {
+	Name           string
+	Address        string
+	Port           int
+	Mode           int
+	AllowedIPs     []string
+	AuthUsername   string
+	AuthPassword   string
+	AuthFile       string // htpasswd file with more users
+	AuthBackend    string // local (auth_user/auth_pass and auth_file), webhook or ldap
+	AuthScheme     string // HTTP schemes offered: basic, digest or both
+	AuthRequired   bool   // Computed flag to avoid repeated string comparisons
 	AuthBasicToken []byte // Pre-computed Basic Auth token (bytes)
+	TLSCert        string // PEM certificate; with TLSKey the listener accepts TLS
+	TLSKey         string // PEM private key
+	TLSMinVersion  uint16 // lowest TLS version accepted
+	TLSClientCA    string // CA bundle for client certificates (mTLS)
+	TLSClientAuth  string // require or optional (passwords still accepted)
+	TLSClientUser  string // certificate field used as username: cn, dns, email or uri
+
+	networks     []*net.IPNet  // Parsed AllowedIPs, filled in by main
+	authBackends []authBackend // Checked in order; empty when auth is off
+	digest       *digestAuth   // Set when auth_scheme offers Digest
+	tlsConfig    *tls.Config   // Set when the listener accepts TLS
+}
+
+// modeName returns the log prefix for the listener's protocol
+func (l *ListenerConfig) modeName() string {
+	switch l.Mode {
+	case modeSocks:
+		return "SOCKS"
+	case modeAuto:
+		return "AUTO"
+	}
+	return "HTTP"
+}
+
+// listenAddr returns the host:port the listener binds to
+func (l *ListenerConfig) listenAddr() string {
+	return net.JoinHostPort(l.Address, fmt.Sprintf("%d", l.Port))
+}
+
+// listenerBlock keeps the raw key/value pairs of one [listener] section
+// until the whole file (and therefore every default) has been read.
+type listenerBlock struct {
+	name string
+	keys [][2]string
 }
 
 // loadConfig loads configuration from the specified file path
@@ -32,17 +130,39 @@ func loadConfig(path string) (*Config, error) {
 	}
 	defer f.Close()
 
-	// Default config with mode=http, port=3128
 	cfg := &Config{
-		isSocks:      false,            //proxy_mode   = http
-		isDebug:      false,            //log_level    = debug
-		isLogOff:     false,            //log_level    = off || none
-		Port:         3128,             //port             = 3128
-		AllowedIPs:   []string{},       //allowed_ip   = 0.0.0.0/0 (cidr)
-		IdleTimeout:  30 * time.Second, //idle_timeout
-		BufferSize:   32 * 1024,        //buffer_size
-		AuthUsername: "",               //auth_username
-		AuthPassword: "",               //auth_password
+		LogLevel:    levelInfo,        //log_level
+		IdleTimeout: 30 * time.Second, //idle_timeout
+		BufferSize:  32 * 1024,        //buffer_size
+		Upstream:    directDialer{},   //upstream_proxy
+		Upstreams:   map[string]Dialer{},
+		Users:       map[string]*userPolicy{},
+		ldap:        newLDAPAuth(),
+		authLimit:   newAuthLimiter(),
+		authFiles:   map[string]*htpasswdFile{},
+		certs:       map[string]*certReloader{},
+
+		DestDefaultAllow: true,             //dest_default = allow
+		AccessLogFormat:  "json",           //access_log_format
+		WebhookTimeout:   5 * time.Second,  //auth_webhook_timeout
+		WebhookTTL:       60 * time.Second, //auth_webhook_ttl
+	}
+
+	// Default listener with mode=http, port=3128
+	defaults := &ListenerConfig{
+		Address:      "0.0.0.0",  //address      = 0.0.0.0
+		Port:         3128,       //port         = 3128
+		Mode:         modeHTTP,   //proxy_mode   = http
+		AllowedIPs:   []string{}, //allowed_ip   = 0.0.0.0/0 (cidr)
+		AuthUsername: "",         //auth_user
+		AuthPassword: "",         //auth_pass
+		AuthFile:     "",         //auth_file
+		AuthBackend:  "local",    //auth_backend
+		AuthScheme:   "basic",    //auth_scheme
+
+		TLSMinVersion: tls.VersionTLS12, //tls_min_version = 1.2
+		TLSClientAuth: "require",        //tls_client_auth
+		TLSClientUser: "cn",             //tls_client_user
 	}
 
 	var content strings.Builder
@@ -60,12 +180,38 @@ func loadConfig(path string) (*Config, error) {
 		}
 	}
 
+	var blocks []*listenerBlock
+	var current *listenerBlock
+	var currentUser *userPolicy
+
 	lines := strings.Split(content.String(), "\n")
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			fields := strings.Fields(line[1 : len(line)-1])
+			if len(fields) == 2 && fields[0] == "user" {
+				if cfg.Users[fields[1]] != nil {
+					return nil, fmt.Errorf("duplicate section %s", line)
+				}
+				current = nil
+				currentUser = newUserPolicy(fields[1])
+				cfg.Users[currentUser.name] = currentUser
+				continue
+			}
+			if len(fields) == 0 || fields[0] != "listener" || len(fields) > 2 {
+				return nil, fmt.Errorf("unknown section %s", line)
+			}
+			currentUser = nil
+			current = &listenerBlock{}
+			if len(fields) == 2 {
+				current.name = fields[1]
+			}
+			blocks = append(blocks, current)
+			continue
+		}
 		parts := strings.SplitN(line, "=", 2)
 		if len(parts) != 2 {
 			continue
@@ -73,23 +219,50 @@ func loadConfig(path string) (*Config, error) {
 		key := strings.TrimSpace(parts[0])
 		val := strings.TrimSpace(parts[1])
 
-		switch key {
-		case "proxy_mode":
-			cfg.isSocks = strings.HasPrefix(strings.ToLower(val), "socks")
-		case "port":
-			var p int
-			fmt.Sscanf(val, "%d", &p)
-			if p > 0 && p < 65536 {
-				cfg.Port = p
+		if current != nil {
+			current.keys = append(current.keys, [2]string{key, val})
+			continue
+		}
+		if currentUser != nil {
+			if err := applyUserKey(currentUser, key, val); err != nil {
+				return nil, fmt.Errorf("user %q: %v", currentUser.name, err)
+			}
+			if key == "dest_rule" || key == "dest_default" {
+				cfg.userDestRules = true
+			}
+			continue
+		}
+
+		if ok, err := applyListenerKey(defaults, key, val); ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if ok, err := applyLDAPKey(cfg.ldap, key, val); ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if ok, err := applyAuthLimitKey(cfg.authLimit, key, val); ok {
+			if err != nil {
+				return nil, err
 			}
+			continue
+		}
+
+		switch key {
 		case "log_file":
 			// deprecated (stdout-only logging); intentionally ignored
 		case "log_level":
-			logLevel := strings.ToLower(val)
-			cfg.isDebug = logLevel == "debug"
-			cfg.isLogOff = logLevel == "off" || logLevel == "none"
-		case "allowed_ip":
-			cfg.AllowedIPs = append(cfg.AllowedIPs, val)
+			level, err := parseLogLevel(val)
+			if err != nil {
+				return nil, err
+			}
+			cfg.LogLevel = level
 		case "idle_timeout":
 			dur, err := time.ParseDuration(val)
 			if err != nil {
@@ -108,27 +281,286 @@ func loadConfig(path string) (*Config, error) {
 				return nil, fmt.Errorf("buffer_size must be > 0")
 			}
 			cfg.BufferSize = size
-		case "auth_user":
-			cfg.AuthUsername = val
-		case "auth_pass":
-			cfg.AuthPassword = val
 		case "log_buffer_size":
 			// deprecated (stdout-only logging); intentionally ignored
+		case "upstream_proxy":
+			if val == "" || strings.EqualFold(val, "direct") {
+				cfg.Upstream = directDialer{}
+				continue
+			}
+			d, err := parseUpstreamProxy(val)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Upstream = d
+		case "upstream":
+			name, rawURL, ok := strings.Cut(val, " ")
+			if !ok || strings.TrimSpace(rawURL) == "" {
+				return nil, fmt.Errorf("invalid upstream %q: want \"<name> <url>\"", val)
+			}
+			if name == routeDirect || name == routeReject {
+				return nil, fmt.Errorf("upstream name %q is reserved", name)
+			}
+			d, err := parseUpstreamProxy(strings.TrimSpace(rawURL))
+			if err != nil {
+				return nil, err
+			}
+			cfg.Upstreams[name] = d
+		case "route":
+			r, err := parseRouteRule(val)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Routes = append(cfg.Routes, r)
+		case "dest_rule":
+			r, err := parseACLRule(val)
+			if err != nil {
+				return nil, err
+			}
+			cfg.DestRules = append(cfg.DestRules, r)
+		case "dest_default":
+			switch strings.ToLower(val) {
+			case "allow":
+				cfg.DestDefaultAllow = true
+			case "deny":
+				cfg.DestDefaultAllow = false
+			default:
+				return nil, fmt.Errorf("dest_default must be allow or deny")
+			}
+		case "metrics_listen":
+			cfg.MetricsListen = val
+		case "admin_listen":
+			if err := checkLoopbackAddr(val); err != nil {
+				return nil, fmt.Errorf("admin_listen: %v", err)
+			}
+			cfg.AdminListen = val
+		case "access_log":
+			if strings.EqualFold(val, "off") || strings.EqualFold(val, "none") {
+				val = ""
+			}
+			cfg.AccessLog = val
+		case "access_log_format":
+			val = strings.ToLower(val)
+			if _, ok := accessFormats[val]; !ok {
+				return nil, fmt.Errorf("unknown access_log_format %q (want json, squid or combined)", val)
+			}
+			cfg.AccessLogFormat = val
+		case "auth_webhook_url":
+			cfg.WebhookURL = val
+		case "auth_webhook_timeout", "auth_webhook_ttl":
+			dur, err := time.ParseDuration(val)
+			if err != nil || dur <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", key, val)
+			}
+			if key == "auth_webhook_timeout" {
+				cfg.WebhookTimeout = dur
+			} else {
+				cfg.WebhookTTL = dur
+			}
+		case "block_private_destinations":
+			cfg.BlockPrivate = parseBool(val)
+		case "private_destination_allow":
+			network, err := parseCIDROrIP(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid private_destination_allow: %v", err)
+			}
+			cfg.PrivateAllow = append(cfg.PrivateAllow, network)
+		case "add_via":
+			cfg.AddVia = parseBool(val)
+		case "add_forwarded":
+			cfg.AddForwarded = parseBool(val)
+		case "add_x_forwarded_for":
+			cfg.AddXForwardedFor = parseBool(val)
+		}
+	}
+
+	if err := resolveRoutes(cfg.Routes, cfg.Upstreams); err != nil {
+		return nil, err
+	}
+
+	// Without [listener] blocks the top-level keys describe the only listener
+	if len(blocks) == 0 {
+		cfg.Listeners = []*ListenerConfig{defaults}
+	}
+	for _, b := range blocks {
+		l := *defaults
+		l.Name = b.name
+		allowedSet := false
+		for _, kv := range b.keys {
+			// allowed_ip inside a block replaces the inherited list instead of extending it
+			if kv[0] == "allowed_ip" && !allowedSet {
+				l.AllowedIPs = nil
+				allowedSet = true
+			}
+			ok, err := applyListenerKey(&l, kv[0], kv[1])
+			if !ok {
+				return nil, fmt.Errorf("listener %q: unknown setting %q", b.name, kv[0])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("listener %q: %v", b.name, err)
+			}
+		}
+		if !allowedSet {
+			l.AllowedIPs = append([]string(nil), defaults.AllowedIPs...)
 		}
+		cfg.Listeners = append(cfg.Listeners, &l)
 	}
 
-	// Compute AuthRequired flag once at startup to avoid repeated string comparisons
-	cfg.AuthRequired = (cfg.AuthUsername != "" && cfg.AuthPassword != "")
+	seen := make(map[string]bool, len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		addr := l.listenAddr()
+		if seen[addr] {
+			return nil, fmt.Errorf("duplicate listener on %s", addr)
+		}
+		seen[addr] = true
+
+		if err := setupAuthBackends(cfg, l); err != nil {
+			return nil, err
+		}
+		if err := setupTLS(cfg, l); err != nil {
+			return nil, err
+		}
+		if l.AuthScheme != authSchemeBasic {
+			// Digest needs the plaintext password, which only auth_user / auth_pass provide
+			if l.AuthBackend != "local" || l.AuthUsername == "" || l.AuthPassword == "" {
+				return nil, fmt.Errorf("auth_scheme = %s needs auth_backend = local with auth_user and auth_pass", l.AuthScheme)
+			}
+			l.digest = newDigestAuth(l.AuthUsername, l.AuthPassword)
+		}
+
+		// Compute AuthRequired flag once at startup to avoid repeated checks
+		l.AuthRequired = len(l.authBackends) > 0 || l.TLSClientCA != ""
+	}
+
+	return cfg, nil
+}
+
+// setupAuthBackends fills in the credential checks of a listener
+func setupAuthBackends(cfg *Config, l *ListenerConfig) error {
+	switch l.AuthBackend {
+	case "webhook":
+		if cfg.WebhookURL == "" {
+			return fmt.Errorf("auth_backend = webhook needs auth_webhook_url")
+		}
+		if cfg.webhook == nil {
+			cfg.webhook = newWebhookAuth(cfg.WebhookURL, cfg.WebhookTimeout, cfg.WebhookTTL)
+		}
+		l.authBackends = []authBackend{cfg.webhook}
+		return nil
+	case "ldap":
+		if err := cfg.ldap.validate(); err != nil {
+			return err
+		}
+		l.authBackends = []authBackend{cfg.ldap}
+		return nil
+	}
 
 	// Pre-compute AuthBasicToken
-	if cfg.AuthRequired {
-		auth := cfg.AuthUsername + ":" + cfg.AuthPassword
-		// "Basic " + base64(user:pass)
-		// We store the full header value "Basic <token>" as bytes for direct comparison
-		// Wait, the plan says: "Pre-compute the Auth Token: ... generate the exact expected HTTP header value: Basic <base64(user:pass)>."
+	if l.AuthUsername != "" && l.AuthPassword != "" {
+		auth := l.AuthUsername + ":" + l.AuthPassword
+		// We store the full header value "Basic <base64(user:pass)>" as bytes for direct comparison
 		encoded := base64.StdEncoding.EncodeToString([]byte(auth))
-		cfg.AuthBasicToken = []byte("Basic " + encoded)
+		l.AuthBasicToken = []byte("Basic " + encoded)
+		l.authBackends = append(l.authBackends, staticAuth{username: l.AuthUsername, password: l.AuthPassword})
 	}
 
-	return cfg, nil
+	// Listeners naming the same auth_file share one copy of it
+	if l.AuthFile != "" {
+		file, ok := cfg.authFiles[l.AuthFile]
+		if !ok {
+			var err error
+			file, err = loadHtpasswdFile(l.AuthFile)
+			if err != nil {
+				return fmt.Errorf("auth_file: %v", err)
+			}
+			cfg.authFiles[l.AuthFile] = file
+		}
+		l.authBackends = append(l.authBackends, file)
+	}
+	return nil
+}
+
+// applyListenerKey applies a per-listener setting.
+// It reports false if key is not a listener setting.
+func applyListenerKey(l *ListenerConfig, key, val string) (bool, error) {
+	switch key {
+	case "proxy_mode":
+		mode := strings.ToLower(val)
+		switch {
+		case mode == "auto":
+			l.Mode = modeAuto
+		case strings.HasPrefix(mode, "socks"):
+			l.Mode = modeSocks
+		default:
+			l.Mode = modeHTTP
+		}
+	case "address":
+		l.Address = strings.Trim(val, "[]")
+	case "port":
+		var p int
+		fmt.Sscanf(val, "%d", &p)
+		if p > 0 && p < 65536 {
+			l.Port = p
+		}
+	case "allowed_ip":
+		l.AllowedIPs = append(l.AllowedIPs, val)
+	case "auth_user":
+		l.AuthUsername = val
+	case "auth_pass":
+		l.AuthPassword = val
+	case "auth_file":
+		l.AuthFile = val
+	case "tls_cert":
+		l.TLSCert = val
+	case "tls_key":
+		l.TLSKey = val
+	case "tls_min_version":
+		version, err := parseTLSVersion(val)
+		if err != nil {
+			return true, err
+		}
+		l.TLSMinVersion = version
+	case "tls_client_ca":
+		l.TLSClientCA = val
+	case "tls_client_auth":
+		switch strings.ToLower(val) {
+		case "require", "optional":
+			l.TLSClientAuth = strings.ToLower(val)
+		default:
+			return true, fmt.Errorf("unknown tls_client_auth %q", val)
+		}
+	case "tls_client_user":
+		switch strings.ToLower(val) {
+		case "cn", "dns", "email", "uri":
+			l.TLSClientUser = strings.ToLower(val)
+		default:
+			return true, fmt.Errorf("unknown tls_client_user %q", val)
+		}
+	case "auth_scheme":
+		switch strings.ToLower(val) {
+		case authSchemeBasic, authSchemeDigest, authSchemeBoth:
+			l.AuthScheme = strings.ToLower(val)
+		default:
+			return true, fmt.Errorf("unknown auth_scheme %q", val)
+		}
+	case "auth_backend":
+		switch strings.ToLower(val) {
+		case "local", "webhook", "ldap":
+			l.AuthBackend = strings.ToLower(val)
+		default:
+			return true, fmt.Errorf("unknown auth_backend %q", val)
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// parseBool accepts the usual on/off spellings of a boolean setting
+func parseBool(val string) bool {
+	switch strings.ToLower(val) {
+	case "1", "on", "yes", "true":
+		return true
+	}
+	return false
 }
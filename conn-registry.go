@@ -0,0 +1,109 @@
+package main
+
+import (
+	"cmp"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry of the client connections being served, for the admin API.
+
+// nextConnID numbers accepted client connections
+var nextConnID atomic.Uint64
+
+// activeConns holds every connection between handleConnection's start and end
+var activeConns = struct {
+	sync.Mutex
+	m map[uint64]*connInfo
+}{m: make(map[uint64]*connInfo)}
+
+// connInfo identifies an accepted client connection and what it is doing now
+type connInfo struct {
+	id         uint64
+	clientIP   string
+	clientAddr string
+	mode       string // http or socks
+	start      time.Time
+	client     net.Conn
+
+	mu     sync.Mutex
+	rec    *accessRecord // tunnel or request in progress; nil between requests
+	remote net.Conn      // its outbound connection
+	user   string        // user of the latest request
+}
+
+// newConnInfo numbers a new client connection and registers it
+func newConnInfo(c net.Conn, addr *net.TCPAddr, mode string) *connInfo {
+	ci := &connInfo{
+		id:         nextConnID.Add(1),
+		clientIP:   addr.IP.String(),
+		clientAddr: addr.String(),
+		mode:       mode,
+		start:      time.Now(),
+		client:     c,
+	}
+	activeConns.Lock()
+	activeConns.m[ci.id] = ci
+	activeConns.Unlock()
+	return ci
+}
+
+// unregister removes a finished connection
+func (ci *connInfo) unregister() {
+	activeConns.Lock()
+	delete(activeConns.m, ci.id)
+	activeConns.Unlock()
+}
+
+// attach makes r the connection's current request
+func (ci *connInfo) attach(r *accessRecord) {
+	ci.mu.Lock()
+	ci.rec, ci.remote, ci.user = r, nil, r.user
+	ci.mu.Unlock()
+}
+
+// detach clears r once it is finished
+func (ci *connInfo) detach(r *accessRecord) {
+	ci.mu.Lock()
+	if ci.rec == r {
+		ci.rec, ci.remote = nil, nil
+	}
+	ci.mu.Unlock()
+}
+
+// current returns the request in progress, the user of the latest one and the
+// address the request connected to
+func (ci *connInfo) current() (rec *accessRecord, user, resolvedIP string) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if ci.rec != nil {
+		resolvedIP = ci.rec.resolvedIP
+	}
+	return ci.rec, ci.user, resolvedIP
+}
+
+// kill closes the client connection and the outbound one, ending any tunnel
+func (ci *connInfo) kill() {
+	ci.mu.Lock()
+	remote := ci.remote
+	ci.mu.Unlock()
+	ci.client.Close()
+	if remote != nil {
+		remote.Close()
+	}
+}
+
+// connections returns the registered connections, oldest first
+func connections() []*connInfo {
+	activeConns.Lock()
+	list := make([]*connInfo, 0, len(activeConns.m))
+	for _, ci := range activeConns.m {
+		list = append(list, ci)
+	}
+	activeConns.Unlock()
+	slices.SortFunc(list, func(a, b *connInfo) int { return cmp.Compare(a.id, b.id) })
+	return list
+}
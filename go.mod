@@ -1,3 +1,5 @@
 module ggproxy
 
 go 1.25.5
+
+require golang.org/x/crypto v0.54.0
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authFileCheckInterval is how often an auth_file is checked for changes
+const authFileCheckInterval = 2 * time.Second
+
+// htpasswdFile is a user database in Apache htpasswd format ("user:hash" per line).
+// Supported hashes: bcrypt ($2a$, $2b$, $2y$), SHA-256/SHA-512 crypt ($5$, $6$) and {SHA}.
+type htpasswdFile struct {
+	path string
+
+	mu      sync.RWMutex
+	users   map[string]string // username -> hash
+	modTime time.Time
+	size    int64
+
+	// verified caches sha256(cacheKey + password) of credentials that already
+	// passed a slow hash check; it is dropped whenever the file is reloaded
+	verified map[string][sha256.Size]byte
+	cacheKey []byte
+}
+
+// loadHtpasswdFile reads an auth_file; errors are fatal at startup
+func loadHtpasswdFile(path string) (*htpasswdFile, error) {
+	f := &htpasswdFile{path: path, cacheKey: make([]byte, 32)}
+	rand.Read(f.cacheKey)
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload re-reads the file, keeping the previous users if it can't be parsed
+func (f *htpasswdFile) reload() error {
+	fh, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(fh)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hashed, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("%s:%d: expected user:hash", f.path, lineNo)
+		}
+		if !supportedHash(hashed) {
+			return fmt.Errorf("%s:%d: unsupported hash for user %q", f.path, lineNo, user)
+		}
+		users[user] = hashed
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.users = users
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.verified = make(map[string][sha256.Size]byte)
+	f.mu.Unlock()
+	return nil
+}
+
+// watch reloads the file whenever its modification time or size changes
+func (f *htpasswdFile) watch() {
+	for range time.Tick(authFileCheckInterval) {
+		f.reloadIfChanged()
+	}
+}
+
+// reloadIfChanged reloads the file if it changed since the last load or failed reload
+func (f *htpasswdFile) reloadIfChanged() {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return
+	}
+	f.mu.RLock()
+	changed := !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+	f.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	if err := f.reload(); err != nil {
+		logError("auth_file reload failed, keeping previous users", "path", f.path, "err", err)
+		// Don't retry until the file changes again
+		f.mu.Lock()
+		f.modTime, f.size = info.ModTime(), info.Size()
+		f.mu.Unlock()
+		return
+	}
+	f.mu.RLock()
+	users := len(f.users)
+	f.mu.RUnlock()
+	logInfo("auth_file reloaded", "path", f.path, "users", users)
+}
+
+// authenticate checks a username/password pair. Unknown users cost the same
+// hash comparison as known ones so response times don't reveal valid names.
+func (f *htpasswdFile) authenticate(r *authRequest) (bool, error) {
+	username, password := r.username, r.password
+
+	f.mu.RLock()
+	hashed, found := f.users[username]
+	cached, isCached := f.verified[username]
+	f.mu.RUnlock()
+
+	digest := f.cacheDigest(password)
+	if isCached && subtle.ConstantTimeCompare(digest[:], cached[:]) == 1 {
+		return true, nil
+	}
+
+	if !found {
+		verifyHash(dummyHash(), password)
+		return false, nil
+	}
+	if !verifyHash(hashed, password) {
+		return false, nil
+	}
+
+	f.mu.Lock()
+	if f.users[username] == hashed {
+		f.verified[username] = digest
+	}
+	f.mu.Unlock()
+	return true, nil
+}
+
+// cacheDigest keys the verified-credentials cache
+func (f *htpasswdFile) cacheDigest(password string) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(f.cacheKey)
+	h.Write([]byte(password))
+	var d [sha256.Size]byte
+	h.Sum(d[:0])
+	return d
+}
+
+var (
+	dummyHashOnce  sync.Once
+	dummyHashValue string
+)
+
+// dummyHash is a bcrypt hash compared against for unknown users
+func dummyHash() string {
+	dummyHashOnce.Do(func() {
+		h, _ := bcrypt.GenerateFromPassword([]byte("ggproxy-dummy-password"), bcrypt.DefaultCost)
+		dummyHashValue = string(h)
+	})
+	return dummyHashValue
+}
+
+// supportedHash reports whether verifyHash understands the hash format
+func supportedHash(hashed string) bool {
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"), strings.HasPrefix(hashed, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hashed))
+		return err == nil
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		_, _, _, ok := parseSHACrypt(hashed)
+		return ok
+	case strings.HasPrefix(hashed, "{SHA}"):
+		return true
+	}
+	return false
+}
+
+// verifyHash checks password against an htpasswd hash in constant time
+func verifyHash(hashed, password string) bool {
+	switch {
+	case strings.HasPrefix(hashed, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		computed, ok := shaCryptWithSalt(hashed, password)
+		return ok && subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+	case strings.HasPrefix(hashed, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+	}
+	return false
+}
+
+// SHA-crypt ($5$ and $6$) as specified by Ulrich Drepper, "Unix crypt using SHA-256 and SHA-512"
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+	cryptAlphabet         = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// Byte order of the final encoding, three digest bytes per group
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// parseSHACrypt splits "$5$[rounds=N$]salt$hash" into its parts
+func parseSHACrypt(hashed string) (id string, rounds int, salt string, ok bool) {
+	parts := strings.Split(hashed, "$")
+	// "", id, [rounds=N,] salt, hash
+	if len(parts) < 4 || parts[0] != "" {
+		return "", 0, "", false
+	}
+	id = parts[1]
+	rest := parts[2:]
+	rounds = shaCryptDefaultRounds
+	if strings.HasPrefix(rest[0], "rounds=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(rest[0], "rounds="))
+		if err != nil {
+			return "", 0, "", false
+		}
+		rounds = min(max(n, shaCryptMinRounds), shaCryptMaxRounds)
+		rest = rest[1:]
+	}
+	if len(rest) != 2 {
+		return "", 0, "", false
+	}
+	salt = rest[0]
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+	return id, rounds, salt, true
+}
+
+// shaCryptWithSalt hashes password with the parameters of an existing hash
+func shaCryptWithSalt(hashed, password string) (string, bool) {
+	id, rounds, salt, ok := parseSHACrypt(hashed)
+	if !ok {
+		return "", false
+	}
+
+	var newHash func() hash.Hash
+	var order [][3]int
+	switch id {
+	case "5":
+		newHash, order = sha256.New, sha256CryptOrder
+	case "6":
+		newHash, order = sha512.New, sha512CryptOrder
+	default:
+		return "", false
+	}
+	sum := shaCrypt(newHash, []byte(password), []byte(salt), rounds)
+
+	prefix := "$" + id + "$"
+	if strings.Contains(hashed, "$rounds=") {
+		prefix += "rounds=" + strconv.Itoa(rounds) + "$"
+	}
+	return prefix + salt + "$" + encodeSHACrypt(sum, order), true
+}
+
+// shaCrypt computes the raw SHA-crypt digest
+func shaCrypt(newHash func() hash.Hash, password, salt []byte, rounds int) []byte {
+	h := newHash()
+	size := h.Size()
+
+	// Digest B = H(password salt password)
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	// Digest A
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	for n := len(password); n > 0; n -= size {
+		h.Write(b[:min(n, size)])
+	}
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	// P sequence from digest DP = H(password repeated len(password) times)
+	h.Reset()
+	for range len(password) {
+		h.Write(password)
+	}
+	dp := h.Sum(nil)
+	p := make([]byte, 0, len(password))
+	for n := len(password); n > 0; n -= size {
+		p = append(p, dp[:min(n, size)]...)
+	}
+
+	// S sequence from digest DS = H(salt repeated 16+A[0] times)
+	h.Reset()
+	for range 16 + int(a[0]) {
+		h.Write(salt)
+	}
+	ds := h.Sum(nil)
+	s := make([]byte, 0, len(salt))
+	for n := len(salt); n > 0; n -= size {
+		s = append(s, ds[:min(n, size)]...)
+	}
+
+	c := a
+	for i := range rounds {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+	return c
+}
+
+// encodeSHACrypt encodes a digest with the crypt alphabet in the given byte order
+func encodeSHACrypt(sum []byte, order [][3]int) string {
+	var out []byte
+	put := func(w uint32, n int) {
+		for range n {
+			out = append(out, cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for _, g := range order {
+		put(uint32(sum[g[0]])<<16|uint32(sum[g[1]])<<8|uint32(sum[g[2]]), 4)
+	}
+	if len(sum) == sha256.Size {
+		put(uint32(sum[31])<<8|uint32(sum[30]), 3)
+	} else {
+		put(uint32(sum[63]), 2)
+	}
+	return string(out)
+}
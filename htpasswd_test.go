@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		hashed   string
+		password string
+	}{
+		// htpasswd -B and the OpenBSD bcrypt test vectors
+		{"bcrypt 2a", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		{"bcrypt 2y", "$2y$05$abcdefghijklmnopqrstuuOQiyCxlgf/oeuTqixKmWdcYUh4Hjl0a", "secret"},
+		// openssl passwd -5 / -6 -salt saltstring
+		{"sha256 crypt", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"sha512 crypt", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		// Test vectors of the SHA-crypt specification, salts cut to 16 bytes
+		{"sha256 crypt rounds", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+		{"sha512 crypt rounds", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.", "Hello world!"},
+		{"sha512 crypt long password", "$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1",
+			"a very much longer text to encrypt.  This one even stretches over morethan one line."},
+		// htpasswd -s
+		{"sha1", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !supportedHash(tt.hashed) {
+				t.Fatal("hash not supported")
+			}
+			if !verifyHash(tt.hashed, tt.password) {
+				t.Error("right password rejected")
+			}
+			if verifyHash(tt.hashed, tt.password+"x") {
+				t.Error("wrong password accepted")
+			}
+		})
+	}
+}
+
+func TestUnsupportedHash(t *testing.T) {
+	for _, hashed := range []string{
+		"plain",
+		"$apr1$salt$hash",
+		"$1$salt$hash",
+		"$2a$bad",
+		"$5$rounds=x$salt$hash",
+		"$5$onlysalt",
+	} {
+		if supportedHash(hashed) {
+			t.Errorf("%q: supported", hashed)
+		}
+		if verifyHash(hashed, "") {
+			t.Errorf("%q: verified", hashed)
+		}
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	write := func(content string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// Later writes within the same clock tick still look changed
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	login := func(f *htpasswdFile, user, password string) bool {
+		ok, _ := f.authenticate(loginAs(user, password))
+		return ok
+	}
+	start := time.Now().Add(-time.Hour)
+
+	write("# users\nalice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", start)
+	f, err := loadHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !login(f, "alice", "password") {
+		t.Fatal("alice rejected")
+	}
+
+	// A changed file replaces the users, and the cached login with them
+	write("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", start.Add(time.Minute))
+	f.reloadIfChanged()
+	if login(f, "alice", "password") || !login(f, "bob", "password") {
+		t.Fatal("change not picked up")
+	}
+
+	// A broken file keeps the users that were loaded
+	write("dave:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\ncarol\n", start.Add(2*time.Minute))
+	f.reloadIfChanged()
+	if !login(f, "bob", "password") || login(f, "dave", "password") {
+		t.Fatal("a file that failed to parse replaced the users")
+	}
+
+	// Fixing it is picked up again
+	write("carol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", start.Add(3*time.Minute))
+	f.reloadIfChanged()
+	if login(f, "bob", "password") || !login(f, "carol", "password") {
+		t.Fatal("fixed file not picked up")
+	}
+
+	if _, err := loadHtpasswdFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing file loaded")
+	}
+}
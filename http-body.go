@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// HTTP/1.1 message framing (RFC 9112 §6). Bodies are relayed byte for byte;
+// the proxy only needs to know where each message ends.
+
+// bodyFraming describes how the end of a message body is found
+type bodyFraming int
+
+const (
+	bodyNone       bodyFraming = iota // no body at all
+	bodyLength                        // Content-Length bytes
+	bodyChunked                       // chunked transfer coding
+	bodyUntilClose                    // response delimited by connection close
+)
+
+// errBadFraming is returned for messages whose length cannot be determined safely
+var errBadFraming = errors.New("invalid message framing")
+
+// headerValue returns the first value of header name and whether it was present
+func headerValue(headers []string, name string) (string, bool) {
+	for _, h := range headers {
+		if k, v, ok := strings.Cut(h, ":"); ok && strings.EqualFold(strings.TrimSpace(k), name) {
+			return strings.TrimSpace(v), true
+		}
+	}
+	return "", false
+}
+
+// headerHasToken reports whether any comma-separated value of header name equals token
+func headerHasToken(headers []string, name, token string) bool {
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), name) {
+			continue
+		}
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// transferCodings returns the codings of every Transfer-Encoding line in order
+func transferCodings(headers []string) []string {
+	var codings []string
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "Transfer-Encoding") {
+			continue
+		}
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				codings = append(codings, t)
+			}
+		}
+	}
+	return codings
+}
+
+// messageFraming determines the framing from Transfer-Encoding and Content-Length
+func messageFraming(headers []string) (bodyFraming, int64, error) {
+	if _, ok := headerValue(headers, "Transfer-Encoding"); ok {
+		codings := transferCodings(headers)
+		if len(codings) == 0 || !strings.EqualFold(codings[len(codings)-1], "chunked") {
+			return bodyUntilClose, 0, nil
+		}
+		for _, c := range codings[:len(codings)-1] {
+			if strings.EqualFold(c, "chunked") {
+				// chunked may only be applied once, as the final coding
+				return bodyNone, 0, errBadFraming
+			}
+		}
+		// Transfer-Encoding wins over Content-Length (RFC 9112 §6.3)
+		return bodyChunked, 0, nil
+	}
+
+	var length int64 = -1
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "Content-Length") {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil || n < 0 || (length >= 0 && n != length) {
+			return bodyNone, 0, errBadFraming
+		}
+		length = n
+	}
+	if length > 0 {
+		return bodyLength, length, nil
+	}
+	return bodyNone, 0, nil
+}
+
+// requestFraming determines how a request body is delimited. A request carrying both
+// Transfer-Encoding and Content-Length is rejected rather than forwarded, since the
+// next hop may pick the other header (RFC 9112 §6.3)
+func requestFraming(headers []string) (bodyFraming, int64, error) {
+	_, hasTE := headerValue(headers, "Transfer-Encoding")
+	_, hasCL := headerValue(headers, "Content-Length")
+	if hasTE && hasCL {
+		return bodyNone, 0, errBadFraming
+	}
+	framing, length, err := messageFraming(headers)
+	if framing == bodyUntilClose {
+		// A request body can't be delimited by closing the connection
+		return bodyNone, 0, errBadFraming
+	}
+	return framing, length, err
+}
+
+// responseFraming determines how a response body is delimited
+func responseFraming(method string, status int, headers []string) (bodyFraming, int64, error) {
+	if strings.EqualFold(method, "HEAD") || (status >= 100 && status < 200) || status == 204 || status == 304 {
+		return bodyNone, 0, nil
+	}
+	framing, length, err := messageFraming(headers)
+	if err != nil {
+		return bodyNone, 0, err
+	}
+	if framing == bodyNone {
+		if _, ok := headerValue(headers, "Content-Length"); !ok {
+			return bodyUntilClose, 0, nil
+		}
+	}
+	return framing, length, nil
+}
+
+// copyBody relays one message body from src to dst, counting its bytes in counter
+func copyBody(dst io.Writer, src *bufio.Reader, framing bodyFraming, length int64, counter *atomic.Int64) error {
+	switch framing {
+	case bodyLength:
+		n, err := copyWithPool(dst, io.LimitReader(src, length), counter)
+		if err == nil && n < length {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	case bodyChunked:
+		return copyChunked(dst, src, counter)
+	case bodyUntilClose:
+		_, err := copyWithPool(dst, src, counter)
+		return err
+	}
+	return nil
+}
+
+// copyChunked relays a chunked body including chunk extensions and trailers
+func copyChunked(dst io.Writer, src *bufio.Reader, counter *atomic.Int64) error {
+	for {
+		line, err := src.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(dst, line); err != nil {
+			return err
+		}
+
+		sizeStr, _, _ := strings.Cut(trimCRLF(line), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("bad chunk size %q", sizeStr)
+		}
+
+		if size == 0 {
+			// Trailer section ends with an empty line
+			for {
+				line, err := src.ReadString('\n')
+				if err != nil {
+					return err
+				}
+				if _, err := io.WriteString(dst, line); err != nil {
+					return err
+				}
+				if trimCRLF(line) == "" {
+					return nil
+				}
+			}
+		}
+
+		// Chunk data followed by CRLF
+		n, err := copyWithPool(dst, io.LimitReader(src, size), counter)
+		if err != nil {
+			return err
+		}
+		if n < size {
+			return io.ErrUnexpectedEOF
+		}
+		line, err = src.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(dst, line); err != nil {
+			return err
+		}
+	}
+}
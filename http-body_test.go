@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRequestFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		framing bodyFraming
+		length  int64
+		wantErr bool
+	}{
+		{"no body", []string{"Host: a"}, bodyNone, 0, false},
+		{"content length", []string{"Content-Length: 12"}, bodyLength, 12, false},
+		{"zero length", []string{"Content-Length: 0"}, bodyNone, 0, false},
+		{"repeated equal length", []string{"Content-Length: 5", "content-length: 5"}, bodyLength, 5, false},
+		{"conflicting length", []string{"Content-Length: 5", "Content-Length: 6"}, bodyNone, 0, true},
+		{"negative length", []string{"Content-Length: -1"}, bodyNone, 0, true},
+		{"bad length", []string{"Content-Length: 1x"}, bodyNone, 0, true},
+		{"chunked", []string{"Transfer-Encoding: chunked"}, bodyChunked, 0, false},
+		{"gzip then chunked", []string{"Transfer-Encoding: gzip, Chunked"}, bodyChunked, 0, false},
+		{"codings on two lines", []string{"Transfer-Encoding: gzip", "Transfer-Encoding: chunked"}, bodyChunked, 0, false},
+		{"chunked not last", []string{"Transfer-Encoding: chunked, gzip"}, bodyNone, 0, true},
+		{"chunked twice", []string{"Transfer-Encoding: chunked", "Transfer-Encoding: chunked"}, bodyNone, 0, true},
+		{"only gzip", []string{"Transfer-Encoding: gzip"}, bodyNone, 0, true},
+		{"empty coding", []string{"Transfer-Encoding: "}, bodyNone, 0, true},
+		{"chunked and length", []string{"Content-Length: 4", "Transfer-Encoding: chunked"}, bodyNone, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			framing, length, err := requestFraming(tt.headers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (framing != tt.framing || length != tt.length) {
+				t.Errorf("got (%d, %d), want (%d, %d)", framing, length, tt.framing, tt.length)
+			}
+		})
+	}
+}
+
+func TestResponseFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		status  int
+		headers []string
+		framing bodyFraming
+	}{
+		{"head", "HEAD", 200, []string{"Content-Length: 10"}, bodyNone},
+		{"no content", "GET", 204, nil, bodyNone},
+		{"not modified", "GET", 304, []string{"Content-Length: 10"}, bodyNone},
+		{"until close", "GET", 200, nil, bodyUntilClose},
+		{"empty length", "GET", 200, []string{"Content-Length: 0"}, bodyNone},
+		{"length", "GET", 200, []string{"Content-Length: 10"}, bodyLength},
+		{"chunked", "GET", 200, []string{"Transfer-Encoding: chunked"}, bodyChunked},
+		{"gzip without chunked", "GET", 200, []string{"Transfer-Encoding: gzip"}, bodyUntilClose},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			framing, _, err := responseFraming(tt.method, tt.status, tt.headers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if framing != tt.framing {
+				t.Errorf("framing = %d, want %d", framing, tt.framing)
+			}
+		})
+	}
+}
+
+func TestCopyChunked(t *testing.T) {
+	body := "5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nTrailer: x\r\n\r\n"
+	src := bufio.NewReader(strings.NewReader(body + "GET /next HTTP/1.1\r\n"))
+	var dst bytes.Buffer
+	var counter atomic.Int64
+
+	if err := copyBody(&dst, src, bodyChunked, 0, &counter); err != nil {
+		t.Fatal(err)
+	}
+	if dst.String() != body {
+		t.Errorf("relayed %q, want %q", dst.String(), body)
+	}
+	if counter.Load() != 11 {
+		t.Errorf("counted %d bytes, want 11", counter.Load())
+	}
+
+	// The next pipelined request must be left unread
+	rest, _ := src.ReadString('\n')
+	if rest != "GET /next HTTP/1.1\r\n" {
+		t.Errorf("left %q after the body", rest)
+	}
+}
+
+func TestCopyChunkedErrors(t *testing.T) {
+	for _, body := range []string{
+		"zz\r\nhello\r\n0\r\n\r\n",
+		"a\r\nshort",
+		"5\r\nhello\r\n",
+	} {
+		var counter atomic.Int64
+		err := copyBody(&bytes.Buffer{}, bufio.NewReader(strings.NewReader(body)), bodyChunked, 0, &counter)
+		if err == nil {
+			t.Errorf("%q: no error", body)
+		}
+	}
+}
+
+func TestCopyBodyLength(t *testing.T) {
+	var dst bytes.Buffer
+	var counter atomic.Int64
+	src := bufio.NewReader(strings.NewReader("hello world"))
+	if err := copyBody(&dst, src, bodyLength, 5, &counter); err != nil {
+		t.Fatal(err)
+	}
+	if dst.String() != "hello" || counter.Load() != 5 {
+		t.Errorf("relayed %q (%d bytes)", dst.String(), counter.Load())
+	}
+
+	err := copyBody(&bytes.Buffer{}, bufio.NewReader(strings.NewReader("abc")), bodyLength, 5, &counter)
+	if err == nil {
+		t.Error("short body: no error")
+	}
+}
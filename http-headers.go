@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// hopByHopHeaders only apply to a single connection and are never forwarded (RFC 9110 §7.6.1).
+// Transfer-Encoding is hop-by-hop too, but bodies are relayed in their original coding so it stays.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"TE",
+	"Upgrade",
+}
+
+// headerName returns the field name of a header line
+func headerName(h string) string {
+	name, _, _ := strings.Cut(h, ":")
+	return strings.TrimSpace(name)
+}
+
+// stripHopByHop removes hop-by-hop headers and every header listed in Connection.
+// When keepUpgrade is set an Upgrade being negotiated survives, together with "Connection: Upgrade".
+func stripHopByHop(headers []string, keepUpgrade bool) []string {
+	// Headers named by Connection are hop-by-hop as well
+	var listed []string
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "Connection") {
+			continue
+		}
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				listed = append(listed, t)
+			}
+		}
+	}
+	keepUpgrade = keepUpgrade && headerHasToken(headers, "Connection", "upgrade")
+
+	out := headers[:0]
+	for _, h := range headers {
+		name := headerName(h)
+		if keepUpgrade && strings.EqualFold(name, "Upgrade") {
+			out = append(out, h)
+			continue
+		}
+		if containsFold(hopByHopHeaders, name) || containsFold(listed, name) {
+			continue
+		}
+		out = append(out, h)
+	}
+	if keepUpgrade {
+		out = append(out, "Connection: Upgrade")
+	}
+	return out
+}
+
+// containsFold reports whether list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// addViaHeader records the proxy in the Via chain (RFC 9110 §7.6.3)
+func addViaHeader(headers []string, version string) []string {
+	protocol := strings.TrimPrefix(version, "HTTP/")
+	return append(headers, "Via: "+protocol+" ggproxy")
+}
+
+// addForwardedHeaders identifies the client to the server with Forwarded (RFC 7239)
+// and/or X-Forwarded-For, extending any values set by earlier proxies.
+func addForwardedHeaders(headers []string, clientIP net.IP, forwarded, xForwardedFor bool) []string {
+	if clientIP == nil {
+		return headers
+	}
+	if ip4 := clientIP.To4(); ip4 != nil {
+		clientIP = ip4
+	}
+
+	if forwarded {
+		node := clientIP.String()
+		if clientIP.To4() == nil {
+			// IPv6 nodes are bracketed and quoted
+			node = "\"[" + node + "]\""
+		}
+		headers = append(headers, "Forwarded: for="+node)
+	}
+
+	if xForwardedFor {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if strings.EqualFold(headerName(headers[i]), "X-Forwarded-For") {
+				headers[i] += ", " + clientIP.String()
+				return headers
+			}
+		}
+		headers = append(headers, "X-Forwarded-For: "+clientIP.String())
+	}
+	return headers
+}
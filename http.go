@@ -6,8 +6,8 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -84,152 +84,443 @@ func readHeaders(reader *bufio.Reader) (headers []string, authHeader string, hos
 	return headers, authHeader, hostHeader, nil
 }
 
-// handleHTTP handles HTTP proxy requests without debug logging
-func handleHTTP(client net.Conn) {
-	defer client.Close()
+// httpUpstream is the server connection kept open between requests of a client connection
+type httpUpstream struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	hostPort string
+	user     string
+	parent   *upstreamDialer // set when conn goes to a parent proxy that takes absolute-form requests
+}
+
+// requestHead renders the request line and headers for this upstream: origin form
+// for a server, absolute form with the parent's credentials for a parent proxy
+func (u *httpUpstream) requestHead(requestLine, proxyRequestLine string, headers []string) string {
+	var head strings.Builder
+	if u.parent != nil {
+		requestLine = proxyRequestLine
+	}
+	head.WriteString(requestLine)
+	head.WriteString("\r\n")
+	for _, h := range headers {
+		head.WriteString(h)
+		head.WriteString("\r\n")
+	}
+	if u.parent != nil {
+		if auth := u.parent.proxyAuthorization(); auth != "" {
+			head.WriteString(auth)
+			head.WriteString("\r\n")
+		}
+	}
+	head.WriteString("\r\n")
+	return head.String()
+}
 
-	client.SetDeadline(time.Now().Add(cfg.IdleTimeout))
+// close closes the upstream connection
+func (u *httpUpstream) close() {
+	if u != nil {
+		u.conn.Close()
+	}
+}
+
+// handleHTTP handles HTTP proxy requests.
+// Every request on a keep-alive connection is parsed, authenticated and routed
+// to its own upstream; the upstream connection is reused while the host stays the same.
+func handleHTTP(client net.Conn, l *ListenerConfig, ci *connInfo) {
+	defer client.Close()
 	defer client.SetDeadline(time.Time{})
 
 	reader := bufio.NewReader(client)
 
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return
-	}
+	var upstream *httpUpstream
+	defer func() { upstream.close() }()
 
-	method, requestURI, version, err := parseRequestLine(line)
-	if err != nil {
-		io.WriteString(client, "HTTP/1.1 400 Bad Request\r\n\r\n")
-		return
-	}
+	// Connection slot of the user's policy, held while that user sends requests here
+	var slot *userPolicy
+	defer func() { slot.release() }()
 
-	headers, authHeader, hostHeader, err := readHeaders(reader)
-	if err != nil {
-		io.WriteString(client, "HTTP/1.1 400 Bad Request\r\n\r\n")
-		return
-	}
+	requests := 0
+	for {
+		client.SetDeadline(time.Now().Add(cfg.IdleTimeout))
 
-	if cfg.AuthRequired {
-		if !validateAuth(authHeader) {
-			io.WriteString(client, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"GGProxy\"\r\n\r\n")
-			if !cfg.isLogOff {
-				logChan <- fmt.Sprintf("HTTP: authentication failed from %s", client.RemoteAddr())
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+
+		method, requestURI, version, err := parseRequestLine(line)
+		if err != nil {
+			writeHTTPStatus(client, "HTTP/1.1", "400 Bad Request", false)
+			logDebug("malformed request", "proto", "http", "client", client.RemoteAddr(), "status", 400)
+			break
+		}
+		logTrace("request line", "proto", "http", "client", client.RemoteAddr(), "line", trimCRLF(line))
+
+		headers, authHeader, hostHeader, err := readHeaders(reader)
+		if err != nil {
+			writeHTTPStatus(client, "HTTP/1.1", "400 Bad Request", false)
+			logDebug("header read error", "proto", "http", "client", client.RemoteAddr(), "err", err)
+			break
+		}
+
+		isConnect := strings.EqualFold(method, "CONNECT")
+		reqFraming, reqLength, err := requestFraming(headers)
+		if err != nil && !isConnect {
+			writeHTTPStatus(client, version, "400 Bad Request", false)
+			logDebug("ambiguous request framing", "proto", "http", "client", client.RemoteAddr(), "status", 400)
+			break
+		}
+
+		// HTTP/1.1 keeps the connection unless told otherwise; HTTP/1.0 always closes
+		keepAlive := version == "HTTP/1.1" && !headerHasToken(headers, "Connection", "close")
+
+		// Where the request goes: the CONNECT target, else the absolute URI or Host header
+		hostPort, newFirstLine := requestURI, ""
+		if !isConnect {
+			var e error
+			hostPort, newFirstLine, e = parseHostPortFromAbsoluteURI(method, requestURI, version)
+			// If absolute URI parsing fails or returns empty host, use Host header
+			if e != nil || hostPort == "" || strings.HasPrefix(hostPort, ":") {
+				if hostHeader == "" {
+					writeHTTPStatus(client, version, "400 Bad Request", false)
+					break
+				}
+				hostPort = hostPortFromHeader(hostHeader)
+				newFirstLine = ""
+			}
+			if newFirstLine == "" {
+				newFirstLine = trimCRLF(line)
+			}
+		}
+
+		// Absolute form of the request, for the access log and parent proxies
+		absoluteURI := requestURI
+		if !isConnect && strings.HasPrefix(requestURI, "/") {
+			absoluteURI = "http://" + hostHeader + requestURI
+		}
+
+		rec := ci.newRecord("http", method, hostPort, "")
+		rec.version = version
+		rec.url = absoluteURI
+		rec.referer, _ = headerValue(headers, "Referer")
+		rec.userAgent, _ = headerValue(headers, "User-Agent")
+		user, authOK, stale := validateAuth(l, authHeader, client, method, requestURI, hostPort)
+		rec.setUser(user)
+		if l.AuthRequired {
+			if !authOK {
+				logWarn("authentication failed", "proto", "http", "client", client.RemoteAddr())
+				if authHeader != "" {
+					metrics.authFailures.inc("http")
+				}
+				// The client may retry with credentials on the same connection
+				challenge := authChallenge(l, stale)
+				if !rejectRequest(client, reader, version, "407 Proxy Authentication Required", challenge, isConnect, reqFraming, reqLength, keepAlive, rec) {
+					break
+				}
+				continue
+			}
+
+			// The user's policy: where they log in from, CONNECT, connection limit
+			p := policyFor(user)
+			status, reason := "", ""
+			switch {
+			case !p.loginAllowed(remoteIP(client)):
+				status, reason = "403 Forbidden", "source address not allowed"
+			case isConnect && !p.connectAllowed():
+				status, reason = "403 Forbidden", "CONNECT not allowed"
+			case p != slot && !p.acquire():
+				status, reason = "429 Too Many Requests", "max_connections reached"
+			}
+			if status != "" {
+				logWarn("user refused: "+reason, "proto", "http", "user", user, "client", client.RemoteAddr())
+				if !rejectRequest(client, reader, version, status, "", isConnect, reqFraming, reqLength, keepAlive, rec) {
+					break
+				}
+				continue
+			}
+			if p != slot {
+				slot.release()
+				slot = p
 			}
+		}
+
+		if isConnect {
+			upstream.close()
+			upstream = nil
+			handleHTTPConnect(client, reader, requestURI, version, user, rec)
 			return
 		}
+
+		logDebug("forwarding request", "proto", "http", "client", client.RemoteAddr(), "method", method, "uri", requestURI)
+
+		headers = stripHopByHop(headers, true)
+		if !keepAlive && !headerHasToken(headers, "Connection", "upgrade") {
+			headers = append(headers, "Connection: close")
+		}
+		if cfg.AddVia {
+			headers = addViaHeader(headers, version)
+		}
+		if cfg.AddForwarded || cfg.AddXForwardedFor {
+			var clientIP net.IP
+			if tcpAddr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+				clientIP = tcpAddr.IP
+			}
+			headers = addForwardedHeaders(headers, clientIP, cfg.AddForwarded, cfg.AddXForwardedFor)
+		}
+
+		requests++
+		proxyLine := method + " " + absoluteURI + " " + version
+		keepAlive, upstream, err = forwardHTTPRequest(client, reader, upstream, hostPort, user, method, newFirstLine, proxyLine, headers, reqFraming, reqLength, keepAlive, rec)
+		rec.done()
+		if err != nil {
+			logDebug("forward failed", "proto", "http", "client", client.RemoteAddr(), "dest", hostPort, "err", err)
+		}
+		if !keepAlive {
+			break
+		}
 	}
 
-	if method == "CONNECT" || method == "connect" {
-		handleHTTPConnect(client, reader, requestURI, version)
-		return
+	if requests > 0 {
+		logInfo("forward done", "proto", "http", "client", client.RemoteAddr(), "requests", requests)
 	}
+}
 
-	hostPort, newFirstLine, e := parseHostPortFromAbsoluteURI(method, requestURI, version)
-	// If absolute URI parsing fails or returns empty host, use Host header
-	if e != nil || hostPort == "" || strings.HasPrefix(hostPort, ":") {
-		if hostHeader != "" {
-			if !strings.Contains(hostHeader, ":") {
-				hostPort = hostHeader + ":80"
-			} else {
-				hostPort = hostHeader
+// forwardHTTPRequest sends one request to hostPort and relays the response back to the client.
+// requestLine is used with servers and proxyRequestLine, in absolute form, with parent proxies.
+// It returns whether the client connection may carry another request and the upstream to reuse.
+// The outcome is noted in rec.
+func forwardHTTPRequest(client net.Conn, reader *bufio.Reader, upstream *httpUpstream, hostPort, user, method, requestLine, proxyRequestLine string,
+	headers []string, reqFraming bodyFraming, reqLength int64, keepAlive bool, rec *accessRecord) (bool, *httpUpstream, error) {
+
+	// Route to the right server: a different host (or user, which routes may depend on)
+	// needs a different connection
+	if upstream != nil && (upstream.hostPort != hostPort || upstream.user != user) {
+		upstream.close()
+		upstream = nil
+	}
+	reused := upstream != nil
+
+	for attempt := 0; ; attempt++ {
+		if upstream == nil {
+			remote, parent, err := dialHTTPTarget(hostPort, user)
+			if err != nil {
+				// The body was never read; the connection can't be reused
+				status := "502 Bad Gateway"
+				rec.status = 502
+				if isNotAllowed(err) {
+					status = "403 Forbidden"
+					rec.status = 403
+				}
+				writeHTTPStatus(client, "HTTP/1.1", status, reqFraming == bodyNone && keepAlive)
+				return reqFraming == bodyNone && keepAlive, nil, err
 			}
-			newFirstLine = "" 
-		} else {
-			io.WriteString(client, "HTTP/1.1 400 Bad Request\r\n\r\n")
-			return
+			upstream = &httpUpstream{conn: remote, reader: bufio.NewReader(remote), hostPort: hostPort, user: user, parent: parent}
+		}
+		upstream.conn.SetDeadline(time.Now().Add(cfg.IdleTimeout))
+
+		_, err := io.WriteString(upstream.conn, upstream.requestHead(requestLine, proxyRequestLine, headers))
+		if err == nil && reqFraming == bodyNone {
+			// Peek so a reused connection the server already closed can be retried
+			_, err = upstream.reader.Peek(1)
+		}
+		if err != nil && reused && attempt == 0 && reqFraming == bodyNone {
+			upstream.close()
+			upstream = nil
+			continue
 		}
+		if err != nil {
+			rec.status = 502
+			writeHTTPStatus(client, "HTTP/1.1", "502 Bad Gateway", false)
+			return false, upstream, err
+		}
+		break
 	}
+	rec.setRemote(upstream.conn)
 
-	remote, err := net.Dial("tcp", hostPort)
+	// Send the body concurrently so "Expect: 100-continue" interim responses reach the client
+	bodyDone := make(chan error, 1)
+	go func() {
+		bodyDone <- copyBody(upstream.conn, reader, reqFraming, reqLength, &rec.bytesIn)
+	}()
+
+	keepAlive, reusable, err := relayHTTPResponse(client, reader, upstream, method, keepAlive, rec)
 	if err != nil {
-		io.WriteString(client, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
-		return
+		// Unblock the body copy before waiting for it
+		upstream.conn.Close()
+		<-bodyDone
+		return false, upstream, err
 	}
-	defer remote.Close()
-	remote.SetDeadline(time.Now().Add(cfg.IdleTimeout))
-	defer remote.SetDeadline(time.Time{})
-
-	if newFirstLine != "" {
-		remote.Write([]byte(newFirstLine + "\r\n"))
-	} else {
-		remote.Write([]byte(line))
+	if err := <-bodyDone; err != nil {
+		return false, upstream, err
 	}
 
-	for _, h := range headers {
-		remote.Write([]byte(h + "\r\n"))
+	if !reusable {
+		upstream.close()
+		upstream = nil
 	}
+	return keepAlive, upstream, nil
+}
 
-	remote.Write([]byte("\r\n"))
+// relayHTTPResponse copies the response (and any 1xx interim responses) to the client.
+// It reports whether the client connection stays open and whether the upstream can be reused.
+func relayHTTPResponse(client net.Conn, reader *bufio.Reader, upstream *httpUpstream, method string, keepAlive bool, rec *accessRecord) (bool, bool, error) {
+	for {
+		statusLine, err := upstream.reader.ReadString('\n')
+		if err != nil {
+			rec.status = 502
+			writeHTTPStatus(client, "HTTP/1.1", "502 Bad Gateway", false)
+			return false, false, err
+		}
+		status, err := parseStatusLine(statusLine)
+		if err != nil {
+			rec.status = 502
+			writeHTTPStatus(client, "HTTP/1.1", "502 Bad Gateway", false)
+			return false, false, err
+		}
+		headers, _, _, err := readHeaders(upstream.reader)
+		if err != nil {
+			rec.status = 502
+			writeHTTPStatus(client, "HTTP/1.1", "502 Bad Gateway", false)
+			return false, false, err
+		}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+		framing, length, err := responseFraming(method, status, headers)
+		if err != nil {
+			rec.status = 502
+			writeHTTPStatus(client, "HTTP/1.1", "502 Bad Gateway", false)
+			return false, false, err
+		}
 
-	// Client -> Remote
-	go func() {
-		defer wg.Done()
-		copyWithPool(remote, reader)
-		if tcpConn, ok := remote.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
+		// A body delimited by close can only be passed on by closing the client connection too
+		reusable := framing != bodyUntilClose && !headerHasToken(headers, "Connection", "close")
+		if framing == bodyUntilClose {
+			keepAlive = false
 		}
-	}()
 
-	// Remote -> Client
-	go func() {
-		defer wg.Done()
-		copyWithPool(client, remote)
-		if tcpConn, ok := client.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
+		headers = stripHopByHop(headers, status == 101)
+		if !keepAlive && status != 101 {
+			headers = append(headers, "Connection: close")
+		}
+		if cfg.AddVia {
+			version, _, _ := strings.Cut(statusLine, " ")
+			headers = addViaHeader(headers, version)
 		}
-	}()
 
-	wg.Wait()
+		var head strings.Builder
+		head.WriteString(trimCRLF(statusLine))
+		head.WriteString("\r\n")
+		for _, h := range headers {
+			head.WriteString(h)
+			head.WriteString("\r\n")
+		}
+		head.WriteString("\r\n")
+		if _, err := io.WriteString(client, head.String()); err != nil {
+			return false, false, err
+		}
+		rec.status = status
 
-	if !cfg.isLogOff {
-		logChan <- fmt.Sprintf("HTTP: forward done for %s", client.RemoteAddr())
+		if status == 101 {
+			// Protocol switched (e.g. WebSocket): relay raw bytes until either side closes
+			tunnelUpgraded(client, reader, upstream, rec)
+			return false, false, nil
+		}
+		if status >= 100 && status < 200 {
+			continue
+		}
+
+		if err := copyBody(client, upstream.reader, framing, length, &rec.bytesOut); err != nil {
+			return false, false, err
+		}
+		return keepAlive, reusable, nil
 	}
 }
 
-// handleHTTPConnect handles HTTP CONNECT tunneling without debug logging
-func handleHTTPConnect(client net.Conn, reader *bufio.Reader, hostPort, httpVersion string) {
-	remote, err := net.Dial("tcp", hostPort)
+// tunnelUpgraded relays an upgraded connection in both directions
+func tunnelUpgraded(client net.Conn, reader *bufio.Reader, upstream *httpUpstream, rec *accessRecord) {
+	relayTunnel(bufferedConn(client, reader), bufferedConn(upstream.conn, upstream.reader), rec)
+}
+
+// parseStatusLine extracts the status code from a response status line
+func parseStatusLine(line string) (int, error) {
+	line = trimCRLF(line)
+	_, rest, ok := strings.Cut(line, " ")
+	if !ok || !strings.HasPrefix(line, "HTTP/") || len(rest) < 3 {
+		return 0, fmt.Errorf("malformed status line")
+	}
+	status, err := strconv.Atoi(rest[:3])
 	if err != nil {
+		return 0, fmt.Errorf("malformed status line")
+	}
+	return status, nil
+}
+
+// connectionHeader returns the Connection header line matching keepAlive
+func connectionHeader(keepAlive bool) string {
+	if keepAlive {
+		return ""
+	}
+	return "Connection: close\r\n"
+}
+
+// rejectRequest answers a request the proxy won't serve. The body is drained so the
+// connection can carry the next request; it reports whether the connection stays open.
+// The request's access record is finished here.
+func rejectRequest(client net.Conn, reader *bufio.Reader, version, status, extraHeaders string,
+	isConnect bool, framing bodyFraming, length int64, keepAlive bool, rec *accessRecord) bool {
+	defer rec.done()
+	rec.status, _ = strconv.Atoi(status[:3])
+	if isConnect || copyBody(io.Discard, reader, framing, length, &rec.bytesIn) != nil {
+		keepAlive = false
+	}
+	io.WriteString(client, version+" "+status+"\r\n"+extraHeaders+"Content-Length: 0\r\n"+connectionHeader(keepAlive)+"\r\n")
+	return keepAlive
+}
+
+// writeHTTPStatus writes a body-less response generated by the proxy itself
+func writeHTTPStatus(client net.Conn, version, status string, keepAlive bool) {
+	io.WriteString(client, version+" "+status+"\r\nContent-Length: 0\r\n"+connectionHeader(keepAlive)+"\r\n")
+}
+
+// handleHTTPConnect handles HTTP CONNECT tunneling
+func handleHTTPConnect(client net.Conn, reader *bufio.Reader, hostPort, httpVersion, user string, rec *accessRecord) {
+	defer rec.done()
+	logDebug("CONNECT request", "proto", "http", "client", client.RemoteAddr(), "dest", hostPort)
+
+	remote, err := dialTarget(hostPort, user)
+	if err != nil {
+		logDebug("connect failed", "proto", "http", "client", client.RemoteAddr(), "dest", hostPort, "err", err)
+		if isNotAllowed(err) {
+			rec.status = 403
+			io.WriteString(client, httpVersion+" 403 Forbidden\r\n\r\n")
+			return
+		}
+		rec.status = 502
 		io.WriteString(client, httpVersion+" 502 Bad Gateway\r\n\r\n")
 		return
 	}
+	rec.setRemote(remote)
 	// Send 200 response
+	rec.status = 200
 	io.WriteString(client, httpVersion+" 200 Connection Established\r\n\r\n")
 
-	if !cfg.isLogOff {
-		logChan <- fmt.Sprintf("HTTP: tunnel established %s <-> %s", client.RemoteAddr(), hostPort)
-	}
+	logInfo("tunnel established", "proto", "http", "client", client.RemoteAddr(), "dest", hostPort)
+	defer observeTunnel("http", time.Now())
 
 	defer remote.Close()
 	remote.SetDeadline(time.Now().Add(cfg.IdleTimeout))
 	defer remote.SetDeadline(time.Time{})
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Client -> Remote
-	go func() {
-		defer wg.Done()
-		copyWithPool(remote, reader)
-		if tcpConn, ok := remote.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
-		}
-	}()
-
-	// Remote -> Client
-	go func() {
-		defer wg.Done()
-		copyWithPool(client, remote)
-		if tcpConn, ok := client.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
-		}
-	}()
+	relayTunnel(bufferedConn(client, reader), remote, rec)
+	logDebug("tunnel closed", "proto", "http", "client", client.RemoteAddr(), "dest", hostPort)
+}
 
-	wg.Wait()
+// hostPortFromHeader turns a Host header value into host:port, defaulting to port 80.
+// Bracketed IPv6 literals such as [::1] or [::1]:8080 are handled.
+func hostPortFromHeader(hostHeader string) string {
+	if _, _, err := net.SplitHostPort(hostHeader); err == nil {
+		return hostHeader
+	}
+	return net.JoinHostPort(strings.Trim(hostHeader, "[]"), "80")
 }
 
 // parseHostPortFromAbsoluteURI parses host and port from absolute URI
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal LDAPv3 client (RFC 4511): simple bind, search and unbind over
+// ldap:// or ldaps://, enough for authenticating proxy users.
+
+// BER tags used by the client
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest     = 0x60
+	ldapBindResponse    = 0x61
+	ldapUnbindRequest   = 0x42
+	ldapSearchRequest   = 0x63
+	ldapSearchEntry     = 0x64
+	ldapSearchDone      = 0x65
+	ldapSearchReference = 0x73
+
+	ldapAuthSimple = 0x80 // [0] simple password in BindRequest
+)
+
+// LDAP search scopes
+const (
+	ldapScopeBase    = 0
+	ldapScopeSubtree = 2
+)
+
+// ldapMaxMessage bounds a single response
+const ldapMaxMessage = 1 << 20
+
+// errLDAPInvalidCredentials is returned by bind for resultCode 49
+var errLDAPInvalidCredentials = errors.New("ldap: invalid credentials")
+
+// berElement is a decoded BER TLV
+type berElement struct {
+	tag      byte
+	content  []byte
+	children []berElement // parsed for constructed elements
+}
+
+// berAppend appends a TLV with the given content
+func berAppend(b []byte, tag byte, content []byte) []byte {
+	b = append(b, tag)
+	n := len(content)
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	case n <= 0xffffff:
+		b = append(b, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, content...)
+}
+
+// berInt encodes a non-negative INTEGER or ENUMERATED
+func berInt(tag byte, v int) []byte {
+	var content []byte
+	for {
+		content = append([]byte{byte(v)}, content...)
+		v >>= 8
+		if v == 0 {
+			break
+		}
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+	return berAppend(nil, tag, content)
+}
+
+// berString encodes an OCTET STRING (or any primitive tag)
+func berString(tag byte, s string) []byte {
+	return berAppend(nil, tag, []byte(s))
+}
+
+// berConstructed wraps already encoded elements
+func berConstructed(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, p := range parts {
+		content = append(content, p...)
+	}
+	return berAppend(nil, tag, content)
+}
+
+// berLength decodes the length octets following a tag. first is the initial
+// length octet and rest holds at least the long-form octets it announces.
+// Servers such as Active Directory always use the 4-octet long form (0x84).
+func berLength(first byte, rest []byte) (n, size int, err error) {
+	if first&0x80 == 0 {
+		return int(first), 0, nil
+	}
+	size = int(first & 0x7f)
+	if size == 0 || size > 4 || len(rest) < size {
+		return 0, 0, errors.New("ber: bad length")
+	}
+	var v uint32
+	for _, c := range rest[:size] {
+		v = v<<8 | uint32(c)
+	}
+	if v > ldapMaxMessage {
+		return 0, 0, errors.New("ldap: message too large")
+	}
+	return int(v), size, nil
+}
+
+// berParse decodes one element from b and returns the rest
+func berParse(b []byte) (berElement, []byte, error) {
+	if len(b) < 2 {
+		return berElement{}, nil, errors.New("ber: short element")
+	}
+	tag := b[0]
+	if tag&0x1f == 0x1f {
+		return berElement{}, nil, errors.New("ber: high tag numbers not supported")
+	}
+	n, size, err := berLength(b[1], b[2:])
+	if err != nil {
+		return berElement{}, nil, err
+	}
+	b = b[2+size:]
+	if len(b) < n {
+		return berElement{}, nil, errors.New("ber: truncated element")
+	}
+	e := berElement{tag: tag, content: b[:n]}
+	if tag&0x20 != 0 {
+		rest := e.content
+		for len(rest) > 0 {
+			child, r, err := berParse(rest)
+			if err != nil {
+				return berElement{}, nil, err
+			}
+			e.children = append(e.children, child)
+			rest = r
+		}
+	}
+	return e, b[n:], nil
+}
+
+// berReadMessage reads one complete element from r
+func berReadMessage(r *bufio.Reader) (berElement, error) {
+	var hdr [6]byte
+	if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+		return berElement{}, err
+	}
+	if size := int(hdr[1] & 0x7f); hdr[1]&0x80 != 0 && size <= 4 {
+		if _, err := io.ReadFull(r, hdr[2:2+size]); err != nil {
+			return berElement{}, err
+		}
+	}
+	n, size, err := berLength(hdr[1], hdr[2:])
+	if err != nil {
+		return berElement{}, err
+	}
+	hdrLen := 2 + size
+	msg := make([]byte, hdrLen+n)
+	copy(msg, hdr[:hdrLen])
+	if _, err := io.ReadFull(r, msg[hdrLen:]); err != nil {
+		return berElement{}, err
+	}
+	e, _, err := berParse(msg)
+	return e, err
+}
+
+// ldapConn is a connection to one LDAP server
+type ldapConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	nextID  int
+	timeout time.Duration
+}
+
+// dialLDAP connects to an ldap:// or ldaps:// URL
+func dialLDAP(rawURL string, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	port := u.Port()
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+		dialer := &net.Dialer{Timeout: timeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), &tls.Config{ServerName: host})
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ldapConn{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// close sends an unbind and closes the connection
+func (c *ldapConn) close() {
+	c.nextID++
+	msg := berConstructed(berSequence, berInt(berInteger, c.nextID), []byte{ldapUnbindRequest, 0x00})
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	c.conn.Write(msg)
+	c.conn.Close()
+}
+
+// send writes one request and returns its message ID
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.nextID++
+	msg := berConstructed(berSequence, berInt(berInteger, c.nextID), op)
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(msg)
+	return c.nextID, err
+}
+
+// receive reads the protocol op of the next response to message id
+func (c *ldapConn) receive(id int) (berElement, error) {
+	for {
+		msg, err := berReadMessage(c.reader)
+		if err != nil {
+			return berElement{}, err
+		}
+		if msg.tag != berSequence || len(msg.children) < 2 || msg.children[0].tag != berInteger {
+			return berElement{}, errors.New("ldap: malformed message")
+		}
+		if berToInt(msg.children[0].content) != id {
+			continue // not ours, e.g. a notice of disconnection
+		}
+		return msg.children[1], nil
+	}
+}
+
+// berToInt decodes a non-negative INTEGER or ENUMERATED
+func berToInt(b []byte) int {
+	v := 0
+	for _, c := range b {
+		v = v<<8 | int(c)
+	}
+	return v
+}
+
+// LDAP result codes the client tells apart
+const (
+	ldapSuccess            = 0
+	ldapSizeLimitExceeded  = 4
+	ldapInvalidCredentials = 49
+)
+
+// ldapResult checks the resultCode of an LDAPResult
+func ldapResult(op berElement) (int, error) {
+	if len(op.children) < 3 || op.children[0].tag != berEnumerated {
+		return 0, errors.New("ldap: malformed result")
+	}
+	switch code := berToInt(op.children[0].content); code {
+	case ldapSuccess:
+		return code, nil
+	case ldapInvalidCredentials:
+		return code, errLDAPInvalidCredentials
+	default:
+		return code, fmt.Errorf("ldap: result code %d: %s", code, op.children[2].content)
+	}
+}
+
+// bind performs a simple bind. An empty password would be an unauthenticated
+// bind (RFC 4513 §5.1.2), which succeeds without checking anything, so it is refused.
+func (c *ldapConn) bind(dn, password string) error {
+	if dn != "" && password == "" {
+		return errLDAPInvalidCredentials
+	}
+	id, err := c.send(berConstructed(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(ldapAuthSimple, password),
+	))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return errors.New("ldap: unexpected response to bind")
+	}
+	_, err = ldapResult(op)
+	return err
+}
+
+// search returns the DNs of the entries matching filter; no attributes are requested
+func (c *ldapConn) search(baseDN string, scope int, filter string, sizeLimit int) ([]string, error) {
+	encodedFilter, err := ldapCompileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	id, err := c.send(berConstructed(ldapSearchRequest,
+		berString(berOctetString, baseDN),
+		berInt(berEnumerated, scope),
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, sizeLimit),
+		berInt(berInteger, int(c.timeout/time.Second)),
+		berAppend(nil, berBoolean, []byte{0xff}), // typesOnly
+		encodedFilter,
+		berConstructed(berSequence, berString(berOctetString, "1.1")), // no attributes
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var dns []string
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchEntry:
+			if len(op.children) == 0 {
+				return nil, errors.New("ldap: malformed search entry")
+			}
+			dns = append(dns, string(op.children[0].content))
+		case ldapSearchReference:
+			// Referrals are not followed
+		case ldapSearchDone:
+			// sizeLimitExceeded still returns the entries found so far
+			if code, err := ldapResult(op); err != nil && code != ldapSizeLimitExceeded {
+				return nil, err
+			}
+			return dns, nil
+		default:
+			return nil, errors.New("ldap: unexpected response to search")
+		}
+	}
+}
+
+// ldapCompileFilter encodes an RFC 4515 string filter such as (&(uid=alice)(objectClass=person))
+func ldapCompileFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	b, rest, err := ldapParseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldap filter: trailing %q", rest)
+	}
+	return b, nil
+}
+
+// ldapParseFilter parses one parenthesized filter and returns the remaining input
+func ldapParseFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") || len(s) < 3 {
+		return nil, "", fmt.Errorf("ldap filter: expected ( at %q", s)
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if s[0] == '|' {
+			tag = 0xa1
+		}
+		s = s[1:]
+		var parts [][]byte
+		for strings.HasPrefix(s, "(") {
+			part, rest, err := ldapParseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			parts = append(parts, part)
+			s = rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", fmt.Errorf("ldap filter: expected ) at %q", s)
+		}
+		return berConstructed(tag, parts...), s[1:], nil
+	case '!':
+		part, rest, err := ldapParseFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", fmt.Errorf("ldap filter: expected ) at %q", rest)
+		}
+		return berConstructed(0xa2, part), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errors.New("ldap filter: missing )")
+	}
+	item, rest := s[:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", fmt.Errorf("ldap filter: bad item %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	tag := byte(0xa3) // equalityMatch
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = 0xa5, attr[:len(attr)-1]
+	case '<':
+		tag, attr = 0xa6, attr[:len(attr)-1]
+	case '~':
+		tag, attr = 0xa8, attr[:len(attr)-1]
+	}
+
+	if tag == 0xa3 && value == "*" {
+		return berString(0x87, attr), rest, nil // present
+	}
+	if tag == 0xa3 && strings.Contains(value, "*") {
+		pieces := strings.Split(value, "*")
+		var subs [][]byte
+		for i, p := range pieces {
+			if p == "" {
+				continue
+			}
+			v, err := ldapUnescapeValue(p)
+			if err != nil {
+				return nil, "", err
+			}
+			subTag := byte(0x81) // any
+			if i == 0 {
+				subTag = 0x80 // initial
+			} else if i == len(pieces)-1 {
+				subTag = 0x82 // final
+			}
+			subs = append(subs, berString(subTag, v))
+		}
+		return berConstructed(0xa4, berString(berOctetString, attr), berConstructed(berSequence, subs...)), rest, nil
+	}
+
+	v, err := ldapUnescapeValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berConstructed(tag, berString(berOctetString, attr), berString(berOctetString, v)), rest, nil
+}
+
+// ldapUnescapeValue decodes \XX escapes in a filter value
+func ldapUnescapeValue(v string) (string, error) {
+	if !strings.Contains(v, "\\") {
+		return v, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			b.WriteByte(v[i])
+			continue
+		}
+		if i+2 >= len(v) {
+			return "", fmt.Errorf("ldap filter: bad escape in %q", v)
+		}
+		c, err := strconv.ParseUint(v[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("ldap filter: bad escape in %q", v)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// ldapEscapeFilter escapes a value for use inside a search filter (RFC 4515 §3)
+func ldapEscapeFilter(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ldapEscapeDN escapes a value for use as an attribute value in a DN (RFC 4514 §2.4)
+func ldapEscapeDN(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == ',' || c == '+' || c == '"' || c == '\\' || c == '<' || c == '>' || c == ';' || c == '=':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString("\\00")
+		case (c == ' ' || c == '#') && i == 0, c == ' ' && i == len(v)-1:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
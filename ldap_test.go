@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// A BindResponse as Active Directory sends it: every length in the 4-octet long form
+var adBindResponse = []byte{
+	0x30, 0x84, 0x00, 0x00, 0x00, 0x10, // LDAPMessage
+	0x02, 0x01, 0x01, // messageID 1
+	0x61, 0x84, 0x00, 0x00, 0x00, 0x07, // BindResponse
+	0x0a, 0x01, 0x00, // resultCode success
+	0x04, 0x00, // matchedDN
+	0x04, 0x00, // diagnosticMessage
+}
+
+func TestBERLongFormLengths(t *testing.T) {
+	msg, err := berReadMessage(bufio.NewReader(bytes.NewReader(adBindResponse)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.tag != berSequence || len(msg.children) != 2 {
+		t.Fatalf("got tag %#x with %d children", msg.tag, len(msg.children))
+	}
+	if id := berToInt(msg.children[0].content); id != 1 {
+		t.Errorf("message ID %d, want 1", id)
+	}
+	op := msg.children[1]
+	if op.tag != ldapBindResponse {
+		t.Fatalf("op tag %#x, want BindResponse", op.tag)
+	}
+	if code, err := ldapResult(op); code != ldapSuccess || err != nil {
+		t.Errorf("result (%d, %v), want success", code, err)
+	}
+
+	e, rest, err := berParse(adBindResponse)
+	if err != nil || len(rest) != 0 || len(e.children) != 2 {
+		t.Errorf("berParse: %v, %d bytes left, %d children", err, len(rest), len(e.children))
+	}
+
+	// invalidCredentials in the same form
+	denied := bytes.Clone(adBindResponse)
+	denied[17] = ldapInvalidCredentials
+	e, _, _ = berParse(denied)
+	if _, err := ldapResult(e.children[1]); !errors.Is(err, errLDAPInvalidCredentials) {
+		t.Errorf("err = %v, want invalid credentials", err)
+	}
+}
+
+func TestBERBadLengths(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"indefinite":      {0x30, 0x80, 0x00, 0x00},
+		"5 length octets": {0x30, 0x85, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00},
+		"over the limit":  {0x30, 0x84, 0x7f, 0xff, 0xff, 0xff},
+		"truncated":       {0x30, 0x84, 0x00, 0x00, 0x00, 0x05, 0x02, 0x01},
+		"short length":    {0x30, 0x82, 0x00},
+	} {
+		if _, _, err := berParse(b); err == nil {
+			t.Errorf("berParse %s: no error", name)
+		}
+		if _, err := berReadMessage(bufio.NewReader(bytes.NewReader(b))); err == nil {
+			t.Errorf("berReadMessage %s: no error", name)
+		}
+	}
+}
+
+func TestBERAppendLengths(t *testing.T) {
+	for _, n := range []int{0, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000} {
+		b := berAppend(nil, berOctetString, make([]byte, n))
+		e, rest, err := berParse(b)
+		if err != nil || len(rest) != 0 || len(e.content) != n {
+			t.Errorf("length %d: %v, %d content bytes", n, err, len(e.content))
+		}
+	}
+}
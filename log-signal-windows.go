@@ -0,0 +1,7 @@
+//go:build windows
+
+package main
+
+// watchLogSignals does nothing on Windows, which has no SIGUSR1 / SIGUSR2;
+// the level can still be set with log_level
+func watchLogSignals() {}
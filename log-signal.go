@@ -0,0 +1,24 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLogSignals changes the log level at runtime:
+// SIGUSR1 makes logging one step more verbose, SIGUSR2 one step quieter.
+func watchLogSignals() {
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range sigs {
+		level := getLogLevel()
+		if sig == syscall.SIGUSR1 {
+			setLogLevel(min(level+1, levelTrace))
+		} else {
+			setLogLevel(max(level-1, levelOff))
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Leveled logging. A message is a short text followed by key=value fields:
+//
+//	17.10.2026 02:16:01 INFO tunnel established proto=socks5 client=10.0.0.5:51234 dest=example.com:443
+//
+// Lines go through logChan to a single writer, so a slow stdout never blocks a
+// connection: when the queue is full, lines are dropped and counted instead.
+
+// logLevel orders messages by verbosity; a message is written when its level is at most the current one
+type logLevel int32
+
+const (
+	levelOff   logLevel = iota
+	levelError          // the proxy or one of its backends is not working
+	levelWarn           // refused clients, failed logins, bans
+	levelInfo           // listeners, tunnels and finished connections
+	levelDebug          // decisions taken for each request
+	levelTrace          // protocol details and single datagrams
+)
+
+// logLevelNames are the log_level values, indexed by level
+var logLevelNames = [...]string{"off", "error", "warn", "info", "debug", "trace"}
+
+// logTimeFormat prefixes every line
+const logTimeFormat = "02.01.2006 15:04:05"
+
+// currentLogLevel is read on every log call and may change at runtime
+var currentLogLevel atomic.Int32
+
+func (l logLevel) String() string {
+	if l < levelOff || l > levelTrace {
+		return strconv.Itoa(int(l))
+	}
+	return logLevelNames[l]
+}
+
+// parseLogLevel reads a log_level value; "basic" and "none" are kept from older configs
+func parseLogLevel(val string) (logLevel, error) {
+	switch v := strings.ToLower(val); v {
+	case "basic":
+		return levelInfo, nil
+	case "none":
+		return levelOff, nil
+	default:
+		for i, name := range logLevelNames {
+			if v == name {
+				return logLevel(i), nil
+			}
+		}
+	}
+	return levelOff, fmt.Errorf("unknown log_level %q (want off, error, warn, info, debug or trace)", val)
+}
+
+// getLogLevel returns the level in effect
+func getLogLevel() logLevel {
+	return logLevel(currentLogLevel.Load())
+}
+
+// setLogLevel changes the level; the change is always logged
+func setLogLevel(l logLevel) {
+	old := logLevel(currentLogLevel.Swap(int32(l)))
+	if old != l && logChan != nil {
+		queueLogLine(formatLogLine(levelInfo, "log level changed", []any{"from", old, "to", l}))
+	}
+}
+
+// logEnabled reports whether messages of level l are written; use it to skip building costly fields
+func logEnabled(l logLevel) bool {
+	return l <= getLogLevel()
+}
+
+func logError(msg string, fields ...any) { logAt(levelError, msg, fields) }
+func logWarn(msg string, fields ...any)  { logAt(levelWarn, msg, fields) }
+func logInfo(msg string, fields ...any)  { logAt(levelInfo, msg, fields) }
+func logDebug(msg string, fields ...any) { logAt(levelDebug, msg, fields) }
+func logTrace(msg string, fields ...any) { logAt(levelTrace, msg, fields) }
+
+// logAt queues a message if its level is enabled
+func logAt(level logLevel, msg string, fields []any) {
+	if !logEnabled(level) {
+		return
+	}
+	queueLogLine(formatLogLine(level, msg, fields))
+}
+
+// queueLogLine hands a line to the writer, dropping it if the queue is full
+func queueLogLine(line string) {
+	select {
+	case logChan <- line:
+	default:
+		metrics.logDropped.Add(1)
+	}
+}
+
+// logFatal writes an error straight to stdout, bypassing the queue, and exits
+func logFatal(msg string, fields ...any) {
+	fmt.Fprintln(os.Stdout, time.Now().Format(logTimeFormat)+" "+formatLogLine(levelError, msg, fields))
+	os.Exit(1)
+}
+
+// formatLogLine renders the level, the message and its key=value fields
+func formatLogLine(level logLevel, msg string, fields []any) string {
+	var b strings.Builder
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.WriteByte(' ')
+		fmt.Fprint(&b, fields[i])
+		b.WriteByte('=')
+		b.WriteString(logValue(fields[i+1]))
+	}
+	return b.String()
+}
+
+// logValue formats a field value, quoting it when it would not read as a single token
+func logValue(v any) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// startLogWriter creates logChan and writes its lines to stdout (journald can capture stdout via systemd)
+func startLogWriter() {
+	logChan = make(chan string, logChanBufferSize)
+	go func() {
+		var reported int64
+		for msg := range logChan {
+			fmt.Fprintln(os.Stdout, time.Now().Format(logTimeFormat)+" "+msg)
+			// Say so once the writer has caught up with a burst it had to drop
+			if dropped := metrics.logDropped.Load(); dropped > reported && len(logChan) == 0 {
+				fmt.Fprintln(os.Stdout, time.Now().Format(logTimeFormat)+" "+
+					formatLogLine(levelWarn, "log lines dropped", []any{"count", dropped - reported}))
+				reported = dropped
+			}
+		}
+	}()
+}
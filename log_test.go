@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestLogQueueFullDrops(t *testing.T) {
+	defer func(ch chan string, level int32) { logChan = ch; currentLogLevel.Store(level) }(logChan, currentLogLevel.Load())
+	logChan = make(chan string, 1)
+	currentLogLevel.Store(int32(levelInfo))
+	before := metrics.logDropped.Load()
+
+	// Nothing reads the queue, so a blocking send would hang here
+	logInfo("first")
+	logInfo("second")
+	logWarn("third")
+
+	if got := <-logChan; got != "INFO first" {
+		t.Errorf("queued %q, want the first line", got)
+	}
+	if n := metrics.logDropped.Load() - before; n != 2 {
+		t.Errorf("%d lines counted as dropped, want 2", n)
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,7 +17,7 @@ import (
 // Setup
 // -----------------------------------------------------
 
-// Logging
+// Config and the log queue
 var (
 	cfg     *Config
 	logChan chan string
@@ -38,32 +41,27 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Setup async logging (stdout only; journald can capture stdout via systemd)
-	logChan = make(chan string, logChanBufferSize)
-	go func() {
-		for msg := range logChan {
-			timestamp := time.Now().Format("02.01.2006 15:04:05")
-			fmt.Fprintln(os.Stdout, timestamp+" "+msg)
-		}
-	}()
+	// Setup async logging
+	setLogLevel(cfg.LogLevel)
+	startLogWriter()
+	go watchLogSignals()
 
 	// Initialize buffer pool
 	initBufferPool()
 
-	// Parse allowed CIDRs
-	var networks []*net.IPNet
-	for _, cidrStr := range cfg.AllowedIPs {
-		ip, ipNet, e := net.ParseCIDR(cidrStr)
-		if e != nil {
-			logChan <- fmt.Sprintf("Invalid CIDR %q (skipped): %v", cidrStr, e)
-			continue
-		}
-		// skip IPv6
-		if ip.To4() == nil {
-			logChan <- fmt.Sprintf("Skipping IPv6 CIDR %q", cidrStr)
-			continue
+	// Pick up auth_file edits without a restart
+	for _, f := range cfg.authFiles {
+		go f.watch()
+	}
+	// and renewed TLS certificates
+	for _, r := range cfg.certs {
+		go r.watch()
+	}
+
+	if cfg.AccessLog != "" {
+		if err := startAccessLog(cfg.AccessLog, cfg.AccessLogFormat); err != nil {
+			logFatal("failed to open access_log", "path", cfg.AccessLog, "err", err)
 		}
-		networks = append(networks, ipNet)
 	}
 
 	// ListenConfig with global keep-alive
@@ -71,77 +69,162 @@ func main() {
 		KeepAlive: 15 * time.Second,
 	}
 
-	addr := fmt.Sprintf("0.0.0.0:%d", cfg.Port)
-	ln, err := lc.Listen(context.Background(), "tcp", addr)
-	if err != nil {
-		logChan <- fmt.Sprintf("Failed to listen on %s: %v", addr, err)
-		os.Exit(1)
+	// Open every listener before serving so a bad address fails the whole start
+	listeners := make([]net.Listener, 0, len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		l.networks = parseAllowedNetworks(l)
+
+		addr := l.listenAddr()
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			logFatal("failed to listen", "addr", addr, "err", err)
+		}
+		defer ln.Close()
+
+		if l.tlsConfig != nil {
+			ln = tls.NewListener(ln, l.tlsConfig)
+		}
+		logInfo("listening", "mode", l.modeName(), "addr", addr, "tls", l.tlsConfig != nil)
+		listeners = append(listeners, ln)
+	}
+
+	if cfg.MetricsListen != "" {
+		ln, err := lc.Listen(context.Background(), "tcp", cfg.MetricsListen)
+		if err != nil {
+			logFatal("failed to listen", "addr", cfg.MetricsListen, "err", err)
+		}
+		defer ln.Close()
+		logInfo("metrics listening", "addr", cfg.MetricsListen)
+		go serveMetrics(ln)
 	}
-	defer ln.Close()
 
-	modeStr := "HTTP"
-	if cfg.isSocks {
-		modeStr = "SOCKS"
+	if cfg.AdminListen != "" {
+		ln, err := lc.Listen(context.Background(), "tcp", cfg.AdminListen)
+		if err != nil {
+			logFatal("failed to listen", "addr", cfg.AdminListen, "err", err)
+		}
+		defer ln.Close()
+		logInfo("admin API listening", "addr", cfg.AdminListen)
+		go serveAdmin(ln)
 	}
-	logChan <- fmt.Sprintf("%s: listening on %s", modeStr, addr)
 
-	// Accept loop
+	var wg sync.WaitGroup
+	for i, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener, l *ListenerConfig) {
+			defer wg.Done()
+			acceptLoop(ln, l)
+		}(ln, cfg.Listeners[i])
+	}
+	wg.Wait()
+}
+
+// parseAllowedNetworks parses the allowed CIDRs of a listener
+func parseAllowedNetworks(l *ListenerConfig) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidrStr := range l.AllowedIPs {
+		_, ipNet, e := net.ParseCIDR(cidrStr)
+		if e != nil {
+			logWarn("invalid allowed_ip skipped", "cidr", cidrStr, "err", e)
+			continue
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks
+}
+
+// acceptLoop accepts connections on ln until the listener is closed
+func acceptLoop(ln net.Listener, l *ListenerConfig) {
+	modeStr := l.modeName()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			if strings.Contains(err.Error(), "use of closed network connection") {
-				os.Exit(0)
-			}
-			if !cfg.isLogOff {
-				logChan <- fmt.Sprintf("%s: Accept error: %v", modeStr, err)
+				return
 			}
+			logError("accept failed", "mode", modeStr, "err", err)
 			continue
 		}
 
-		go handleConnection(conn, networks)
+		go handleConnection(conn, l)
 	}
 }
 
 // handleConnection handles incoming connections
-func handleConnection(c net.Conn, networks []*net.IPNet) {
+func handleConnection(c net.Conn, l *ListenerConfig) {
 	defer c.Close()
+	metrics.accepted.Add(1)
 
 	remoteAddr, ok := c.RemoteAddr().(*net.TCPAddr)
 	if !ok {
-		if !cfg.isLogOff {
-			modeStr := "HTTP"
-			if cfg.isSocks {
-				modeStr = "SOCKS"
-			}
-			logChan <- fmt.Sprintf("%s: Could not parse remote address: %v", modeStr, c.RemoteAddr())
-		}
+		logWarn("could not parse remote address", "mode", l.modeName(), "client", c.RemoteAddr())
 		return
 	}
 
-	if !isAllowed(remoteAddr.IP, networks) {
-		if !cfg.isLogOff {
-			modeStr := "HTTP"
-			if cfg.isSocks {
-				modeStr = "SOCKS"
-			}
-			logChan <- fmt.Sprintf("%s: Denying client %s (not in allowed ranges)", modeStr, remoteAddr.IP)
-		}
+	if !isAllowed(remoteAddr.IP, l.networks) {
+		logWarn("client denied: not in allowed ranges", "mode", l.modeName(), "client", remoteAddr.IP)
+		metrics.denied.inc("allowed_ip")
+		return
+	}
+
+	// A ban earned on an auth listener doesn't refuse the client on open listeners
+	if until, banned := cfg.authLimit.ipBanned(remoteAddr.IP); banned && l.AuthRequired {
+		logWarn("client denied: banned", "mode", l.modeName(), "client", remoteAddr.IP, "until", until.Format(time.TimeOnly))
+		metrics.denied.inc("banned")
 		return
 	}
 
 	c.SetReadDeadline(time.Now().Add(10 * time.Second))
 
-	if cfg.isSocks {
-		if cfg.isDebug {
-			handleSocksDebug(c)
-		} else {
-			handleSocks(c)
+	// Finish the TLS handshake before reading the request
+	if tc, ok := c.(*tls.Conn); ok {
+		tc.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := tc.Handshake(); err != nil {
+			logInfo("TLS handshake failed", "mode", l.modeName(), "client", remoteAddr, "err", err)
+			return
 		}
-	} else {
-		if cfg.isDebug {
-			handleHTTPDebug(c)
-		} else {
-			handleHTTP(c)
+		tc.SetWriteDeadline(time.Time{})
+	}
+
+	mode := l.Mode
+	if mode == modeAuto {
+		var ok bool
+		c, mode, ok = detectProtocol(c)
+		if !ok {
+			logInfo("unrecognized protocol", "mode", l.modeName(), "client", remoteAddr)
+			return
 		}
 	}
+
+	metrics.active.inc(modeLabel(mode))
+	defer metrics.active.add(modeLabel(mode), -1)
+
+	ci := newConnInfo(c, remoteAddr, modeLabel(mode))
+	defer ci.unregister()
+	logTrace("new connection", "mode", modeLabel(mode), "client", remoteAddr)
+	if mode == modeSocks {
+		handleSocks(c, l, ci)
+	} else {
+		handleHTTP(c, l, ci)
+	}
+}
+
+// detectProtocol peeks at the first byte sent by the client to choose between
+// SOCKS (version byte 0x05 or 0x04) and HTTP (an ASCII method token).
+// The returned conn replays the peeked byte to the handler.
+func detectProtocol(c net.Conn) (net.Conn, int, bool) {
+	reader := bufio.NewReaderSize(c, 512)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return c, 0, false
+	}
+
+	pc := &peekedConn{Conn: c, reader: reader}
+	switch b := first[0]; {
+	case b == 0x05 || b == 0x04:
+		return pc, modeSocks, true
+	case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z':
+		return pc, modeHTTP, true
+	}
+	return c, 0, false
 }
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMain sets up the pieces main normally initializes before serving
+func TestMain(m *testing.M) {
+	cfg = &Config{
+		IdleTimeout:      30 * time.Second,
+		BufferSize:       32 * 1024,
+		Upstream:         directDialer{},
+		Upstreams:        map[string]Dialer{},
+		Users:            map[string]*userPolicy{},
+		DestDefaultAllow: true,
+		authLimit:        newAuthLimiter(),
+	}
+	initBufferPool()
+	os.Exit(m.Run())
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Prometheus metrics, served in the text exposition format on metrics_listen.
+// Every label has a fixed set of values, so plain atomics are enough.
+
+// metrics holds the process-wide counters
+var metrics = newProxyMetrics()
+
+// tunnelBuckets are the upper bounds of the tunnel duration histogram, in seconds
+var tunnelBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// proxyMetrics groups everything exported on /metrics
+type proxyMetrics struct {
+	active       *labeledValues // connections being served, by mode
+	accepted     atomic.Int64   // connections accepted
+	denied       *labeledValues // connections closed before being served, by reason
+	authFailures *labeledValues // failed logins, by protocol
+	dialErrors   *labeledValues // failed outbound connections, by reason
+	bans         *labeledValues // bans imposed, by kind
+
+	bytesIn  atomic.Int64 // payload read from clients (bodies and tunnels)
+	bytesOut atomic.Int64 // payload written to clients
+
+	logDropped atomic.Int64 // log lines dropped while the writer was behind
+
+	tunnels map[string]*histogram // tunnel durations, by mode
+}
+
+// newProxyMetrics creates the metric set with all label values at zero
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		active:       newLabeledValues("mode", "http", "socks"),
+		denied:       newLabeledValues("reason", "allowed_ip", "banned"),
+		authFailures: newLabeledValues("protocol", "http", "socks4", "socks5"),
+		dialErrors:   newLabeledValues("reason", "denied", "dns", "refused", "timeout", "other"),
+		bans:         newLabeledValues("kind", "ip", "user"),
+		tunnels: map[string]*histogram{
+			"http":  newHistogram(tunnelBuckets),
+			"socks": newHistogram(tunnelBuckets),
+		},
+	}
+}
+
+// labeledValues is a counter or gauge with one label
+type labeledValues struct {
+	label  string
+	values []string
+	counts []atomic.Int64
+}
+
+// newLabeledValues creates the series for every label value
+func newLabeledValues(label string, values ...string) *labeledValues {
+	return &labeledValues{label: label, values: values, counts: make([]atomic.Int64, len(values))}
+}
+
+// add changes the series of one label value; unknown values are ignored
+func (v *labeledValues) add(value string, delta int64) {
+	for i, name := range v.values {
+		if name == value {
+			v.counts[i].Add(delta)
+			return
+		}
+	}
+}
+
+// inc adds one to the series of value
+func (v *labeledValues) inc(value string) {
+	v.add(value, 1)
+}
+
+// histogram counts observations into fixed buckets
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+}
+
+// newHistogram creates a histogram with the given upper bounds
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// observe records one value
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// observeTunnel records how long a tunnel of mode ("http" or "socks") was open; use with defer
+func observeTunnel(mode string, start time.Time) {
+	metrics.tunnels[mode].observe(time.Since(start).Seconds())
+}
+
+// modeLabel returns the mode label of a detected protocol
+func modeLabel(mode int) string {
+	if mode == modeSocks {
+		return "socks"
+	}
+	return "http"
+}
+
+// dialErrorReason classifies an error returned by dialTarget
+func dialErrorReason(err error) string {
+	var netErr net.Error
+	switch {
+	case isNotAllowed(err):
+		return "denied"
+	case isDNSError(err):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// serveMetrics serves /metrics on ln until the listener is closed
+func serveMetrics(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.write(w)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+		logError("metrics server stopped", "err", err)
+	}
+}
+
+// write renders all metrics in the Prometheus text format
+func (m *proxyMetrics) write(w io.Writer) {
+	var b strings.Builder
+
+	writeLabeled(&b, "ggproxy_connections_active", "gauge", "Client connections being served.", m.active)
+	writeSingle(&b, "ggproxy_connections_accepted_total", "counter", "Client connections accepted.", m.accepted.Load())
+	writeLabeled(&b, "ggproxy_connections_denied_total", "counter", "Client connections closed before being served.", m.denied)
+	writeLabeled(&b, "ggproxy_auth_failures_total", "counter", "Failed proxy logins.", m.authFailures)
+	writeLabeled(&b, "ggproxy_dial_errors_total", "counter", "Outbound connections that could not be opened.", m.dialErrors)
+
+	b.WriteString("# HELP ggproxy_bytes_total Payload bytes relayed; in is read from clients, out is written to them.\n")
+	b.WriteString("# TYPE ggproxy_bytes_total counter\n")
+	fmt.Fprintf(&b, "ggproxy_bytes_total{direction=\"in\"} %d\n", m.bytesIn.Load())
+	fmt.Fprintf(&b, "ggproxy_bytes_total{direction=\"out\"} %d\n", m.bytesOut.Load())
+
+	b.WriteString("# HELP ggproxy_tunnel_duration_seconds Lifetime of CONNECT and SOCKS tunnels.\n")
+	b.WriteString("# TYPE ggproxy_tunnel_duration_seconds histogram\n")
+	for _, mode := range []string{"http", "socks"} {
+		m.tunnels[mode].write(&b, "ggproxy_tunnel_duration_seconds", `mode="`+mode+`"`)
+	}
+
+	writeLabeled(&b, "ggproxy_auth_bans_total", "counter", "Bans imposed after failed logins.", m.bans)
+	ips, users := cfg.authLimit.activeBans()
+	b.WriteString("# HELP ggproxy_auth_bans_active Client IPs and usernames currently banned.\n")
+	b.WriteString("# TYPE ggproxy_auth_bans_active gauge\n")
+	fmt.Fprintf(&b, "ggproxy_auth_bans_active{kind=\"ip\"} %d\n", ips)
+	fmt.Fprintf(&b, "ggproxy_auth_bans_active{kind=\"user\"} %d\n", users)
+
+	writeSingle(&b, "ggproxy_log_queue_length", "gauge", "Log messages waiting to be written.", int64(len(logChan)))
+	writeSingle(&b, "ggproxy_log_queue_capacity", "gauge", "Size of the log message queue.", int64(cap(logChan)))
+	writeSingle(&b, "ggproxy_log_lines_dropped_total", "counter", "Log messages dropped because the queue was full.", m.logDropped.Load())
+
+	io.WriteString(w, b.String())
+}
+
+// writeSingle renders a metric without labels
+func writeSingle(b *strings.Builder, name, kind, help string, value int64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// writeLabeled renders every series of a labeled metric
+func writeLabeled(b *strings.Builder, name, kind, help string, v *labeledValues) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for i, value := range v.values {
+		fmt.Fprintf(b, "%s{%s=%q} %d\n", name, v.label, value, v.counts[i].Load())
+	}
+}
+
+// write renders the bucket, sum and count series of one histogram
+func (h *histogram) write(b *strings.Builder, name, labels string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum := h.sum
+	h.mu.Unlock()
+
+	var cumulative uint64
+	for i, c := range counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=%q} %d\n", name, labels, le, cumulative)
+	}
+	fmt.Fprintf(b, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, cumulative)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// userPolicy restricts what an authenticated user may do. It is configured in a
+// [user <name>] section; users without a section are only bound by the global settings.
+type userPolicy struct {
+	name string
+
+	allowedIPs   []*net.IPNet // client addresses the user may log in from; empty means any
+	destRules    []*aclRule   // checked before the global dest_rule lines
+	destDefault  *bool        // overrides dest_default when set
+	allowConnect bool         // HTTP CONNECT tunnels
+	allowSocks   bool         // SOCKS4 and SOCKS5
+	maxConns     int          // concurrent client connections; 0 means unlimited
+
+	active atomic.Int64
+}
+
+// newUserPolicy returns a policy that allows everything
+func newUserPolicy(name string) *userPolicy {
+	return &userPolicy{name: name, allowConnect: true, allowSocks: true}
+}
+
+// applyUserKey applies a setting of a [user] section
+func applyUserKey(p *userPolicy, key, val string) error {
+	switch key {
+	case "allowed_ip":
+		network, err := parseCIDROrIP(val)
+		if err != nil {
+			return err
+		}
+		p.allowedIPs = append(p.allowedIPs, network)
+	case "dest_rule":
+		r, err := parseACLRule(val)
+		if err != nil {
+			return err
+		}
+		p.destRules = append(p.destRules, r)
+	case "dest_default":
+		var allow bool
+		switch strings.ToLower(val) {
+		case "allow":
+			allow = true
+		case "deny":
+			allow = false
+		default:
+			return fmt.Errorf("dest_default must be allow or deny")
+		}
+		p.destDefault = &allow
+	case "allow_connect":
+		p.allowConnect = parseBool(val)
+	case "allow_socks":
+		p.allowSocks = parseBool(val)
+	case "max_connections":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid max_connections %q", val)
+		}
+		p.maxConns = n
+	default:
+		return fmt.Errorf("unknown user setting %q", key)
+	}
+	return nil
+}
+
+// policyFor returns the policy of an authenticated user, or nil if there is none.
+// All policy methods accept a nil receiver and then allow everything.
+func policyFor(user string) *userPolicy {
+	if user == "" {
+		return nil
+	}
+	return cfg.Users[user]
+}
+
+// loginAllowed reports whether the user may log in from ip
+func (p *userPolicy) loginAllowed(ip net.IP) bool {
+	if p == nil || len(p.allowedIPs) == 0 {
+		return true
+	}
+	return isAllowed(ip, p.allowedIPs)
+}
+
+// socksAllowed reports whether the user may use SOCKS4 or SOCKS5
+func (p *userPolicy) socksAllowed() bool {
+	return p == nil || p.allowSocks
+}
+
+// connectAllowed reports whether the user may open HTTP CONNECT tunnels
+func (p *userPolicy) connectAllowed() bool {
+	return p == nil || p.allowConnect
+}
+
+// acquire takes a connection slot, failing when the user is at max_connections
+func (p *userPolicy) acquire() bool {
+	if p == nil || p.maxConns == 0 {
+		return true
+	}
+	if p.active.Add(1) > int64(p.maxConns) {
+		p.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+// release gives back a slot taken by acquire
+func (p *userPolicy) release() {
+	if p == nil || p.maxConns == 0 {
+		return
+	}
+	p.active.Add(-1)
+}
+
+// admitSocksUser applies a user's policy to a SOCKS login and takes a connection slot.
+// proto (socks4 or socks5) is logged; the caller releases the slot when the connection ends.
+func admitSocksUser(client net.Conn, user, proto string) bool {
+	if reason := socksRefusal(client, user); reason != "" {
+		logWarn("user refused: "+reason, "proto", proto, "user", user, "client", client.RemoteAddr())
+		return false
+	}
+	return true
+}
+
+// socksRefusal is admitSocksUser without the log line. It returns why the user
+// is refused, or "" once a connection slot is taken.
+func socksRefusal(client net.Conn, user string) string {
+	p := policyFor(user)
+	switch {
+	case !p.socksAllowed():
+		return "SOCKS not allowed"
+	case !p.loginAllowed(remoteIP(client)):
+		return "source address not allowed"
+	case !p.acquire():
+		return "max_connections reached"
+	}
+	return ""
+}
+
+// remoteIP returns the IP address of the peer of c
+func remoteIP(c net.Conn) net.IP {
+	if tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// errRouteRejected is returned by dialTarget when a route rule rejects the destination
+var errRouteRejected = errors.New("destination rejected by route")
+
+// destination is an outbound target as seen by route rules
+type destination struct {
+	host string // host name or IP literal
+	port int
+	user string // authenticated username, "" without auth
+
+	ips      []net.IP // resolved lazily for cidr rules on host names
+	resolved bool
+}
+
+// newDestination splits hostPort into a destination for rule matching
+func newDestination(hostPort, user string) (*destination, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	return &destination{host: strings.TrimSuffix(strings.ToLower(host), "."), port: port, user: user}, nil
+}
+
+// addrs returns the destination IPs, resolving a host name at most once
+func (d *destination) addrs() []net.IP {
+	if !d.resolved {
+		d.resolved = true
+		if ip := net.ParseIP(d.host); ip != nil {
+			d.ips = []net.IP{ip}
+		} else if ips, err := net.LookupIP(d.host); err == nil {
+			d.ips = ips
+		}
+	}
+	return d.ips
+}
+
+// destMatcher matches destinations by domain, CIDR, port or user
+type destMatcher struct {
+	kind    string // domain, cidr, port, user or any
+	domain  string // lower-case, without the wildcard/suffix marker
+	match   int    // domainExact, domainWildcard or domainSuffix
+	network *net.IPNet
+	portLo  int
+	portHi  int
+	user    string
+}
+
+// Domain match styles
+const (
+	domainExact    = iota // example.com
+	domainWildcard        // *.example.com: subdomains only
+	domainSuffix          // .example.com: the domain and all subdomains
+)
+
+// parseDestMatcher parses "<kind> <value>" such as "domain .example.com" or "port 8000-9000"
+func parseDestMatcher(kind, value string) (*destMatcher, error) {
+	m := &destMatcher{kind: strings.ToLower(kind)}
+	switch m.kind {
+	case "domain":
+		value = strings.TrimSuffix(strings.ToLower(value), ".")
+		switch {
+		case strings.HasPrefix(value, "*."):
+			m.match, m.domain = domainWildcard, value[2:]
+		case strings.HasPrefix(value, "."):
+			m.match, m.domain = domainSuffix, value[1:]
+		default:
+			m.match, m.domain = domainExact, value
+		}
+		if m.domain == "" {
+			return nil, fmt.Errorf("empty domain")
+		}
+	case "cidr":
+		network, err := parseCIDROrIP(value)
+		if err != nil {
+			return nil, err
+		}
+		m.network = network
+	case "port":
+		lo, hi, isRange := strings.Cut(value, "-")
+		if !isRange {
+			hi = lo
+		}
+		var err1, err2 error
+		m.portLo, err1 = strconv.Atoi(strings.TrimSpace(lo))
+		m.portHi, err2 = strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || m.portLo < 1 || m.portHi > 65535 || m.portLo > m.portHi {
+			return nil, fmt.Errorf("invalid port range %q", value)
+		}
+	case "user":
+		if value == "" {
+			return nil, fmt.Errorf("empty user")
+		}
+		m.user = value
+	default:
+		return nil, fmt.Errorf("unknown match %q", kind)
+	}
+	return m, nil
+}
+
+// parseCIDROrIP parses a CIDR; a bare address is a single-host network
+func parseCIDROrIP(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q: %v", value, err)
+	}
+	return network, nil
+}
+
+// matches reports whether the destination matches
+func (m *destMatcher) matches(d *destination) bool {
+	switch m.kind {
+	case "any":
+		return true
+	case "domain":
+		switch m.match {
+		case domainExact:
+			return d.host == m.domain
+		case domainWildcard:
+			return strings.HasSuffix(d.host, "."+m.domain)
+		default:
+			return d.host == m.domain || strings.HasSuffix(d.host, "."+m.domain)
+		}
+	case "cidr":
+		for _, ip := range d.addrs() {
+			if m.network.Contains(ip) {
+				return true
+			}
+		}
+	case "port":
+		return d.port >= m.portLo && d.port <= m.portHi
+	case "user":
+		return d.user == m.user
+	}
+	return false
+}
+
+// Route targets other than a named upstream
+const (
+	routeDirect = "direct"
+	routeReject = "reject"
+)
+
+// routeRule sends matching destinations to a target
+type routeRule struct {
+	matcher *destMatcher
+	target  string // direct, reject or an upstream name
+	dialer  Dialer // resolved once the whole config is read; nil for reject
+}
+
+// parseRouteRule parses "<kind> <value> <target>" or "default <target>"
+func parseRouteRule(val string) (*routeRule, error) {
+	fields := strings.Fields(val)
+	if len(fields) == 2 && strings.EqualFold(fields[0], "default") {
+		return &routeRule{matcher: &destMatcher{kind: "any"}, target: fields[1]}, nil
+	}
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid route %q: want \"<domain|cidr|port|user> <value> <target>\"", val)
+	}
+	m, err := parseDestMatcher(fields[0], fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid route %q: %v", val, err)
+	}
+	return &routeRule{matcher: m, target: fields[2]}, nil
+}
+
+// resolveRoutes binds every rule target to a dialer
+func resolveRoutes(rules []*routeRule, upstreams map[string]Dialer) error {
+	for _, r := range rules {
+		switch strings.ToLower(r.target) {
+		case routeDirect:
+			r.dialer = directDialer{}
+		case routeReject:
+			r.dialer = nil
+		default:
+			d, ok := upstreams[r.target]
+			if !ok {
+				return fmt.Errorf("route target %q is not a defined upstream", r.target)
+			}
+			r.dialer = d
+		}
+	}
+	return nil
+}
+
+// matchRoute returns the first rule matching a destination, nil when none does
+func matchRoute(d *destination) *routeRule {
+	for _, r := range cfg.Routes {
+		if r.matcher.matches(d) {
+			return r
+		}
+	}
+	return nil
+}
+
+// selectRoute returns the dialer for a destination; nil means rejected.
+// The first matching rule wins; without a match upstream_proxy (or direct) is used.
+func selectRoute(d *destination) Dialer {
+	if r := matchRoute(d); r != nil {
+		return r.dialer
+	}
+	return cfg.Upstream
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDestMatcher(t *testing.T) {
+	tests := []struct {
+		kind, value string
+		hostPort    string
+		user        string
+		want        bool
+	}{
+		{"domain", "example.com", "example.com:443", "", true},
+		{"domain", "example.com", "EXAMPLE.com.:443", "", true},
+		{"domain", "example.com", "www.example.com:443", "", false},
+		{"domain", "*.example.com", "www.example.com:443", "", true},
+		{"domain", "*.example.com", "a.b.example.com:443", "", true},
+		{"domain", "*.example.com", "example.com:443", "", false},
+		{"domain", "*.example.com", "badexample.com:443", "", false},
+		{"domain", ".example.com", "example.com:443", "", true},
+		{"domain", ".example.com", "www.example.com:443", "", true},
+		{"domain", ".example.com", "badexample.com:443", "", false},
+		{"cidr", "10.0.0.0/8", "10.1.2.3:80", "", true},
+		{"cidr", "10.0.0.0/8", "192.0.2.1:80", "", false},
+		{"cidr", "2001:db8::1", "[2001:db8::1]:80", "", true},
+		{"port", "443", "example.com:443", "", true},
+		{"port", "443", "example.com:8443", "", false},
+		{"port", "8000-9000", "example.com:8000", "", true},
+		{"port", "8000-9000", "example.com:9000", "", true},
+		{"port", "8000-9000", "example.com:9001", "", false},
+		{"port", "8000-9000", "example.com:7999", "", false},
+		{"user", "alice", "example.com:443", "alice", true},
+		{"user", "alice", "example.com:443", "bob", false},
+		{"user", "alice", "example.com:443", "", false},
+	}
+	for _, tt := range tests {
+		m, err := parseDestMatcher(tt.kind, tt.value)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.kind, tt.value, err)
+		}
+		d, err := newDestination(tt.hostPort, tt.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.matches(d); got != tt.want {
+			t.Errorf("%s %s against %s (user %q) = %v, want %v", tt.kind, tt.value, tt.hostPort, tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestParseRouteRuleErrors(t *testing.T) {
+	for _, val := range []string{
+		"domain example.com",
+		"domain . direct",
+		"port 0 direct",
+		"port 9000-8000 direct",
+		"port 1-65536 direct",
+		"cidr 10.0.0.0/33 direct",
+		"host example.com direct",
+		"default",
+	} {
+		if _, err := parseRouteRule(val); err == nil {
+			t.Errorf("%q: no error", val)
+		}
+	}
+}
+
+// namedDialer stands in for a configured upstream
+type namedDialer string
+
+func (namedDialer) Dial(string) (net.Conn, error) { return nil, nil }
+
+func TestSelectRoute(t *testing.T) {
+	upstreams := map[string]Dialer{"corp": namedDialer("corp"), "eu": namedDialer("eu")}
+	parse := func(rules ...string) []*routeRule {
+		t.Helper()
+		var parsed []*routeRule
+		for _, val := range rules {
+			r, err := parseRouteRule(val)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed = append(parsed, r)
+		}
+		if err := resolveRoutes(parsed, upstreams); err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	saved := *cfg
+	t.Cleanup(func() { *cfg = saved })
+	cfg.Upstream = namedDialer("upstream_proxy")
+
+	route := func(hostPort, user string) Dialer {
+		t.Helper()
+		d, err := newDestination(hostPort, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return selectRoute(d)
+	}
+
+	cfg.Routes = parse(
+		"domain .internal.example direct",
+		"domain *.example.com corp",
+		"domain www.example.com reject", // shadowed by the rule above
+		"port 25 reject",
+		"user bob eu",
+	)
+	tests := []struct {
+		hostPort, user string
+		want           Dialer
+	}{
+		{"db.internal.example:5432", "", directDialer{}},
+		{"www.example.com:443", "", namedDialer("corp")},
+		{"mail.example.org:25", "bob", nil},
+		{"example.org:443", "bob", namedDialer("eu")},
+		// No rule matches: upstream_proxy
+		{"example.org:443", "alice", namedDialer("upstream_proxy")},
+	}
+	for _, tt := range tests {
+		if got := route(tt.hostPort, tt.user); got != tt.want {
+			t.Errorf("%s (user %q) routed to %v, want %v", tt.hostPort, tt.user, got, tt.want)
+		}
+	}
+
+	// A default rule overrides upstream_proxy
+	cfg.Routes = parse("port 25 reject", "default eu")
+	if got := route("example.org:443", ""); got != namedDialer("eu") {
+		t.Errorf("routed to %v, want the default eu", got)
+	}
+	if got := route("example.org:25", ""); got != nil {
+		t.Errorf("routed to %v, want rejected before the default", got)
+	}
+
+	if err := resolveRoutes([]*routeRule{{matcher: &destMatcher{kind: "any"}, target: "nowhere"}}, upstreams); err == nil {
+		t.Error("unknown upstream resolved")
+	}
+}
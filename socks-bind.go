@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// handleSocksBind serves a BIND request (RFC 1928 §4), used by protocols such as
+// active-mode FTP where the destination connects back to the client.
+// dstHost is the host expected to connect; connections from other hosts are refused.
+// user is the authenticated username dest_rule lines may match on.
+// reply sends SOCKS5 reply codes in the client's protocol version; rec counts the relayed bytes.
+func handleSocksBind(client net.Conn, dstHost, user string, reply socksReplier, rec *accessRecord) {
+	localAddr, _ := client.LocalAddr().(*net.TCPAddr)
+	if localAddr == nil {
+		reply(0x01, nil)
+		return
+	}
+
+	// Resolve the expected peer up front; an unspecified address accepts anyone
+	var expected []net.IP
+	if ip := net.ParseIP(dstHost); ip != nil {
+		if !ip.IsUnspecified() {
+			expected = []net.IP{ip}
+		}
+	} else {
+		ips, err := net.LookupIP(dstHost)
+		if err != nil || len(ips) == 0 {
+			logInfo("BIND resolve failed", "proto", rec.mode, "client", client.RemoteAddr(), "host", dstHost, "err", err)
+			reply(0x04, nil)
+			return
+		}
+		expected = ips
+	}
+
+	// Listen on the address the client reached us on, which is also how the peer will reach us
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localAddr.IP})
+	if err != nil {
+		logError("BIND listen failed", "proto", rec.mode, "client", client.RemoteAddr(), "err", err)
+		reply(0x01, nil)
+		return
+	}
+	defer ln.Close()
+
+	// First reply: the address the peer should connect to
+	if err := reply(0x00, ln.Addr()); err != nil {
+		return
+	}
+	logDebug("BIND listening", "proto", rec.mode, "client", client.RemoteAddr(), "addr", ln.Addr(), "expect", dstHost)
+
+	ln.SetDeadline(time.Now().Add(cfg.IdleTimeout))
+	remote, err := ln.AcceptTCP()
+	if err != nil {
+		logInfo("BIND accept failed", "proto", rec.mode, "client", client.RemoteAddr(), "err", err)
+		reply(0x06, nil)
+		return
+	}
+	ln.Close()
+	defer remote.Close()
+	rec.setRemote(remote)
+
+	peer := remote.RemoteAddr().(*net.TCPAddr)
+	if !bindPeerExpected(peer.IP, expected) {
+		logWarn("BIND refused unexpected peer", "proto", rec.mode, "client", client.RemoteAddr(), "peer", peer)
+		reply(0x02, nil)
+		return
+	}
+	if !bindPeerAllowed(dstHost, peer, user) {
+		logWarn("BIND peer denied by dest_rule", "proto", rec.mode, "client", client.RemoteAddr(), "peer", peer)
+		reply(0x02, nil)
+		return
+	}
+
+	// Second reply: who connected
+	if err := reply(0x00, peer); err != nil {
+		return
+	}
+	logInfo("BIND tunnel established", "proto", rec.mode, "client", client.RemoteAddr(), "peer", peer)
+	defer observeTunnel("socks", time.Now())
+
+	remote.SetDeadline(time.Now().Add(cfg.IdleTimeout))
+	defer remote.SetDeadline(time.Time{})
+
+	relayTunnel(client, remote, rec)
+}
+
+// bindPeerAllowed applies dest_rule lines to the peer of a BIND.
+// The peer is matched by the host named in the request and by its actual address.
+func bindPeerAllowed(dstHost string, peer *net.TCPAddr, user string) bool {
+	if !aclActive() {
+		return true
+	}
+	host := strings.TrimSuffix(strings.ToLower(dstHost), ".")
+	if net.ParseIP(host) != nil {
+		// IP requests (including 0.0.0.0) are matched by the address that connected
+		host = peer.IP.String()
+	}
+	d := &destination{host: host, port: peer.Port, user: user, ips: []net.IP{peer.IP}, resolved: true}
+	return destinationAllowed(d)
+}
+
+// bindPeerExpected reports whether ip is one of the expected BIND peers
+func bindPeerExpected(ip net.IP, expected []net.IP) bool {
+	if len(expected) == 0 {
+		return true
+	}
+	for _, e := range expected {
+		if e.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxUDPPacket is the largest datagram the relay reads in one go
+const maxUDPPacket = 64 * 1024
+
+// socksReply builds a SOCKS5 reply with addr as BND.ADDR and BND.PORT
+func socksReply(rep byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	return appendSocksAddr([]byte{0x05, rep, 0x00}, ip, port)
+}
+
+// appendSocksAddr appends ATYP, the address and the port in SOCKS5 wire format
+func appendSocksAddr(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, 0x01)
+		b = append(b, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		b = append(b, 0x04)
+		b = append(b, ip16...)
+	} else {
+		b = append(b, 0x01, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// parseSocksUDPHeader splits a client datagram into destination and payload.
+// Layout: RSV(2) FRAG(1) ATYP(1) DST.ADDR DST.PORT(2) DATA
+func parseSocksUDPHeader(pkt []byte) (hostPort string, data []byte, err error) {
+	if len(pkt) < 4 {
+		return "", nil, errors.New("short datagram")
+	}
+	if pkt[2] != 0x00 {
+		// Fragmentation is optional (RFC 1928 §7); fragments are dropped
+		return "", nil, errors.New("fragmented datagram")
+	}
+
+	var host string
+	rest := pkt[4:]
+	switch pkt[3] {
+	case 0x01: // IPv4
+		if len(rest) < 4+2 {
+			return "", nil, errors.New("short IPv4 header")
+		}
+		host = net.IP(rest[:4]).String()
+		rest = rest[4:]
+	case 0x03: // Domain
+		if len(rest) < 1 || len(rest) < 1+int(rest[0])+2 {
+			return "", nil, errors.New("short domain header")
+		}
+		host = string(rest[1 : 1+rest[0]])
+		if !validHostname(host) {
+			return "", nil, errors.New("invalid host name")
+		}
+		rest = rest[1+rest[0]:]
+	case 0x04: // IPv6
+		if len(rest) < 16+2 {
+			return "", nil, errors.New("short IPv6 header")
+		}
+		host = net.IP(rest[:16]).String()
+		rest = rest[16:]
+	default:
+		return "", nil, fmt.Errorf("unknown addrType=%d", pkt[3])
+	}
+
+	port := binary.BigEndian.Uint16(rest[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), rest[2:], nil
+}
+
+// udpAssociation is the state of one SOCKS5 UDP ASSOCIATE session
+type udpAssociation struct {
+	control  net.Conn     // TCP connection that owns the association
+	relay    *net.UDPConn // socket the client sends to and receives from
+	outbound *net.UDPConn // socket facing the destinations
+
+	clientIP   net.IP // only datagrams from this address are relayed
+	clientPort int    // 0 when the client did not announce its port
+	user       string // authenticated username for dest_rule matching
+	rec        *accessRecord
+
+	clientAddr   atomic.Pointer[net.UDPAddr] // learned from the first client datagram
+	lastActivity atomic.Int64                // unix nanos of the last relayed datagram
+
+	// Addresses the client has sent datagrams to; only their replies are relayed
+	mu        sync.Mutex
+	contacted map[netip.AddrPort]bool
+
+	closeOnce sync.Once
+}
+
+// maxUDPPeers bounds the contacted set of one association
+const maxUDPPeers = 1024
+
+// addPeer notes that the client sent a datagram to addr
+func (a *udpAssociation) addPeer(addr *net.UDPAddr) {
+	ap := unmapAddrPort(addr.AddrPort())
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.contacted[ap] && len(a.contacted) >= maxUDPPeers {
+		clear(a.contacted)
+	}
+	a.contacted[ap] = true
+}
+
+// isPeer reports whether the client has sent a datagram to addr
+func (a *udpAssociation) isPeer(addr *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.contacted[unmapAddrPort(addr.AddrPort())]
+}
+
+// unmapAddrPort turns IPv4-mapped IPv6 addresses into plain IPv4 ones
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// close tears down both sockets and the controlling TCP connection
+func (a *udpAssociation) close() {
+	a.closeOnce.Do(func() {
+		a.relay.Close()
+		a.outbound.Close()
+		a.control.Close()
+	})
+}
+
+// touch records activity for the idle timeout
+func (a *udpAssociation) touch() {
+	a.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idle reports whether no datagram was relayed for cfg.IdleTimeout
+func (a *udpAssociation) idle() bool {
+	return time.Since(time.Unix(0, a.lastActivity.Load())) >= cfg.IdleTimeout
+}
+
+// handleSocksUDPAssociate serves a UDP ASSOCIATE request (RFC 1928 §7).
+// dstPort is the port the client says it will send from (0 if unknown); datagrams
+// are only accepted from the IP of the controlling TCP connection.
+// The association ends when the TCP connection closes or stays idle for idle_timeout.
+// Payload bytes in both directions are counted in rec.
+func handleSocksUDPAssociate(client net.Conn, dstPort uint16, user string, rec *accessRecord) {
+	remoteAddr, _ := client.RemoteAddr().(*net.TCPAddr)
+	localAddr, _ := client.LocalAddr().(*net.TCPAddr)
+	if remoteAddr == nil || localAddr == nil {
+		sendSocksResponse(client, rec, socksResponseCmdNotSupported)
+		return
+	}
+
+	// Bind the relay on the address the client reached us on so BND.ADDR is routable for it
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		logError("UDP relay listen failed", "proto", "socks5", "client", remoteAddr, "err", err)
+		sendSocksResponse(client, rec, socksResponseGeneralFailure)
+		return
+	}
+	outbound, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		relay.Close()
+		logError("UDP outbound listen failed", "proto", "socks5", "client", remoteAddr, "err", err)
+		sendSocksResponse(client, rec, socksResponseGeneralFailure)
+		return
+	}
+
+	a := &udpAssociation{
+		control:  client,
+		relay:    relay,
+		outbound: outbound,
+		clientIP: remoteAddr.IP,
+		user:     user,
+		rec:      rec,
+
+		contacted: make(map[netip.AddrPort]bool),
+	}
+	// A non-zero DST.PORT restricts the association further
+	a.clientPort = int(dstPort)
+	a.touch()
+	defer a.close()
+
+	rec.status = 0x00
+	if _, err := client.Write(socksReply(0x00, relay.LocalAddr())); err != nil {
+		return
+	}
+	logInfo("UDP association established", "proto", "socks5", "client", remoteAddr, "relay", relay.LocalAddr())
+
+	// The control connection carries no data; its closure ends the association
+	client.SetDeadline(time.Time{})
+	go func() {
+		io.Copy(io.Discard, client)
+		a.close()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.relayFromClient()
+	}()
+	go func() {
+		defer wg.Done()
+		a.relayToClient()
+	}()
+	wg.Wait()
+
+	logInfo("UDP association closed", "proto", "socks5", "client", remoteAddr)
+}
+
+// readUDP reads one datagram, closing the association once it has been idle long enough
+func (a *udpAssociation) readUDP(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, bool) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(cfg.IdleTimeout))
+		n, from, err := conn.ReadFromUDP(buf)
+		if err == nil {
+			return n, from, true
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && !a.idle() {
+			continue
+		}
+		a.close()
+		return 0, nil, false
+	}
+}
+
+// relayFromClient decapsulates client datagrams and sends them to their destination
+func (a *udpAssociation) relayFromClient() {
+	buf := make([]byte, maxUDPPacket)
+	// Resolved destinations; nil marks one denied by dest_rule, route or block_private_destinations
+	resolved := make(map[string]*net.UDPAddr)
+
+	for {
+		n, from, ok := a.readUDP(a.relay, buf)
+		if !ok {
+			return
+		}
+		// Restrict the association to the client that requested it
+		if !from.IP.Equal(a.clientIP) || (a.clientPort != 0 && from.Port != a.clientPort) {
+			logTrace("UDP datagram from unexpected sender dropped", "proto", "socks5", "from", from)
+			continue
+		}
+		a.clientAddr.Store(from)
+
+		hostPort, data, err := parseSocksUDPHeader(buf[:n])
+		if err != nil {
+			logTrace("UDP datagram dropped", "proto", "socks5", "from", from, "err", err)
+			continue
+		}
+
+		dst, found := resolved[hostPort]
+		if !found {
+			if dst, err = net.ResolveUDPAddr("udp", hostPort); err != nil {
+				logDebug("UDP resolve failed", "proto", "socks5", "from", from, "dest", hostPort, "err", err)
+				continue
+			}
+			if !a.destinationAllowed(hostPort, dst.IP) {
+				dst = nil
+			}
+			if len(resolved) >= 1024 {
+				clear(resolved)
+			}
+			resolved[hostPort] = dst
+		}
+		if dst == nil {
+			logTrace("UDP datagram denied", "proto", "socks5", "from", from, "dest", hostPort)
+			continue
+		}
+
+		a.addPeer(dst)
+		if _, err := a.outbound.WriteToUDP(data, dst); err != nil {
+			logDebug("UDP send failed", "proto", "socks5", "dest", dst, "err", err)
+			continue
+		}
+		a.rec.bytesIn.Add(int64(len(data)))
+		a.touch()
+	}
+}
+
+// destinationAllowed applies block_private_destinations, dest_rule and route lines
+// to a datagram destination. Everything is checked on ip, the resolved address
+// the datagrams are actually sent to.
+func (a *udpAssociation) destinationAllowed(hostPort string, ip net.IP) bool {
+	if cfg.BlockPrivate && privateDestination(ip) {
+		return false
+	}
+	if !aclActive() && len(cfg.Routes) == 0 {
+		return true
+	}
+	d, err := newDestination(hostPort, a.user)
+	if err != nil {
+		return false
+	}
+	d.ips, d.resolved = []net.IP{ip}, true
+	if !destinationAllowed(d) {
+		return false
+	}
+	// Upstream proxies don't carry the datagrams, so a route to one drops them like reject.
+	// Unrouted destinations go direct, as documented for upstream_proxy.
+	if r := matchRoute(d); r != nil {
+		_, direct := r.dialer.(directDialer)
+		return direct
+	}
+	return true
+}
+
+// relayToClient encapsulates datagrams from destinations and returns them to the
+// client. Like a port-restricted NAT, it only passes replies from addresses the
+// client has sent to, so others can't inject datagrams into the association.
+func (a *udpAssociation) relayToClient() {
+	buf := make([]byte, maxUDPPacket)
+	// Room for the largest header (IPv6) in front of the payload
+	pkt := make([]byte, 0, 3+1+16+2+maxUDPPacket)
+
+	for {
+		n, from, ok := a.readUDP(a.outbound, buf)
+		if !ok {
+			return
+		}
+		clientAddr := a.clientAddr.Load()
+		if clientAddr == nil {
+			continue
+		}
+		if !a.isPeer(from) {
+			logTrace("UDP datagram from unknown peer dropped", "proto", "socks5", "from", from)
+			continue
+		}
+
+		pkt = appendSocksAddr(append(pkt[:0], 0x00, 0x00, 0x00), from.IP, from.Port)
+		pkt = append(pkt, buf[:n]...)
+		if _, err := a.relay.WriteToUDP(pkt, clientAddr); err != nil {
+			logDebug("UDP send to client failed", "proto", "socks5", "client", clientAddr, "err", err)
+			continue
+		}
+		a.rec.bytesOut.Add(int64(n))
+		a.touch()
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPAssociation runs an association for a loopback client and returns
+// the client's control connection and the relay address
+func startUDPAssociation(t *testing.T) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	control, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { control.Close() })
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &accessRecord{conn: &connInfo{}, mode: "socks5", method: "UDP_ASSOCIATE"}
+	go handleSocksUDPAssociate(server, 0, "", rec)
+
+	var reply [10]byte
+	control.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(control, reply[:]); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x00 || reply[3] != 0x01 {
+		t.Fatalf("reply %x", reply)
+	}
+	return control, &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return c
+}
+
+func TestUDPAssociateRepliesOnlyFromPeers(t *testing.T) {
+	_, relay := startUDPAssociation(t)
+	client, peer, stranger := listenUDP(t), listenUDP(t), listenUDP(t)
+	peerAddr := peer.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, 1024)
+
+	// client -> peer through the relay
+	pkt := appendSocksAddr([]byte{0, 0, 0}, peerAddr.IP, peerAddr.Port)
+	if _, err := client.WriteToUDP(append(pkt, "ping"...), relay); err != nil {
+		t.Fatal(err)
+	}
+	n, outbound, err := peer.ReadFromUDP(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("peer got %q, %v", buf[:n], err)
+	}
+
+	// A host the client never sent to learns the outbound port and tries to inject
+	if _, err := stranger.WriteToUDP([]byte("injected"), outbound); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.WriteToUDP([]byte("pong"), outbound); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(appendSocksAddr([]byte{0, 0, 0}, peerAddr.IP, peerAddr.Port), "pong"...)
+	if string(buf[:n]) != string(want) {
+		t.Errorf("client got %q, want the peer's %q", buf[:n], want)
+	}
+}
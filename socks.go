@@ -2,100 +2,184 @@ package main
 
 import (
 	"encoding/binary"
-	"fmt"
 	"io"
 	"net"
 	"strconv"
-	"sync"
 	"time"
 )
 
+// SOCKS5 command codes
+const (
+	socksCmdConnect      = 0x01
+	socksCmdBind         = 0x02
+	socksCmdUDPAssociate = 0x03
+)
+
 // Pre-allocated SOCKS5 response constants to avoid repeated allocations
 var (
 	socksResponseSuccess          = []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
-	socksResponseCmdNotSupported  = []byte{0x05, 0x07, 0x00, 0x01}
-	socksResponseHostUnreachable  = []byte{0x05, 0x04, 0x00, 0x01}
-	socksResponseAddrNotSupported = []byte{0x05, 0x08, 0x00, 0x01}
+	socksResponseGeneralFailure   = []byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+	socksResponseNotAllowed       = []byte{0x05, 0x02, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+	socksResponseCmdNotSupported  = []byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+	socksResponseHostUnreachable  = []byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+	socksResponseAddrNotSupported = []byte{0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
 	socksResponseConnRefused      = []byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
 )
 
-// handleSocks handles SOCKS5 proxy requests without debug logging
-func handleSocks(client net.Conn) {
+// validHostname reports whether a host name sent by a client holds only the
+// bytes of DNS names and IP literals, so it can't forge log lines or headers
+func validHostname(host string) bool {
+	if host == "" || len(host) > 255 {
+		return false
+	}
+	for i := 0; i < len(host); i++ {
+		switch c := host[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-' || c == '.' || c == '_' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// socksReplier sends a reply carrying a SOCKS5 reply code and bound address.
+// Commands shared by SOCKS4 and SOCKS5 report their progress through it.
+type socksReplier func(rep byte, addr net.Addr) error
+
+// socks5Replier writes SOCKS5 replies to client
+func socks5Replier(client net.Conn) socksReplier {
+	return func(rep byte, addr net.Addr) error {
+		_, err := client.Write(socksReply(rep, addr))
+		return err
+	}
+}
+
+// socksCmdName names a SOCKS command in the access log
+func socksCmdName(cmd byte) string {
+	switch cmd {
+	case socksCmdConnect:
+		return "CONNECT"
+	case socksCmdBind:
+		return "BIND"
+	case socksCmdUDPAssociate:
+		return "UDP_ASSOCIATE"
+	}
+	return strconv.Itoa(int(cmd))
+}
+
+// sendSocksResponse writes a pre-allocated SOCKS5 response and notes its reply code in rec
+func sendSocksResponse(client net.Conn, rec *accessRecord, resp []byte) error {
+	rec.status = int(resp[1])
+	_, err := client.Write(resp)
+	return err
+}
+
+// handleSocks handles SOCKS5 proxy requests; SOCKS4 requests are passed on to handleSocks4
+func handleSocks(client net.Conn, l *ListenerConfig, ci *connInfo) {
 	defer client.Close()
 
 	// Set idle timeout
 	client.SetDeadline(time.Now().Add(cfg.IdleTimeout))
 	defer client.SetDeadline(time.Time{})
 
+	remoteAddr := client.RemoteAddr()
+
 	var buf [256]byte
-	// read (VER, NMETHODS, METHODS...)
-	n, err := io.ReadAtLeast(client, buf[:], 2)
-	if err != nil {
+	// read VER alone; SOCKS4 requests continue with a different layout
+	if _, err := io.ReadFull(client, buf[:1]); err != nil {
+		logDebug("handshake error", "proto", "socks5", "client", remoteAddr, "err", err)
 		return
 	}
 	ver := buf[0]
+	if ver == 0x04 {
+		handleSocks4(client, l, ci)
+		return
+	}
 	if ver != 0x05 {
-		if !cfg.isLogOff {
-			logChan <- fmt.Sprintf("SOCKS: Invalid version %d from %s", ver, client.RemoteAddr())
-		}
+		logInfo("invalid SOCKS version", "client", remoteAddr, "version", ver)
 		return
 	}
-	methodsCount := int(buf[1])
 
-	need := 2 + methodsCount
-	if n < need {
-		if _, err := io.ReadFull(client, buf[n:need]); err != nil {
-			return
-		}
+	// read (NMETHODS, METHODS...)
+	if _, err := io.ReadFull(client, buf[:1]); err != nil {
+		logDebug("handshake error", "proto", "socks5", "client", remoteAddr, "err", err)
+		return
+	}
+	methodsCount := int(buf[0])
+	if _, err := io.ReadFull(client, buf[:methodsCount]); err != nil {
+		logDebug("reading methods failed", "proto", "socks5", "client", remoteAddr, "err", err)
+		return
 	}
 
-	// Check if auth is required using pre-computed flag
+	// Check if auth is required using pre-computed flag;
+	// a verified client certificate stands in for the password
+	certUser := clientCertUser(l, client)
 	var selectedMethod byte = 0x00 // no auth
-	if cfg.AuthRequired {
+	if l.AuthRequired && certUser == "" {
 		selectedMethod = 0x02 // username/password auth
 	}
 
 	// respond with selected method
-	_, err = client.Write([]byte{0x05, selectedMethod})
+	_, err := client.Write([]byte{0x05, selectedMethod})
 	if err != nil {
+		logDebug("handshake write failed", "proto", "socks5", "client", remoteAddr, "err", err)
 		return
 	}
+	logTrace("handshake done", "proto", "socks5", "client", remoteAddr, "methods", methodsCount, "method", selectedMethod)
 
 	// If username/password auth is required, handle subnegotiation
+	var user string
+	var login *authRequest // password login, asked about again with the destination
 	if selectedMethod == 0x02 {
-		if !authenticateSocks(client) {
-			if !cfg.isLogOff {
-				logChan <- fmt.Sprintf("SOCKS: authentication failed from %s", client.RemoteAddr())
-			}
+		var refusal string
+		var ok bool
+		login, refusal, ok = authenticateSocks(client, l)
+		if refusal != "" {
+			// Right password, but the user's policy says no
+			logWarn("user refused: "+refusal, "proto", "socks5", "user", login.username, "client", remoteAddr)
+			return
+		}
+		if !ok {
+			logWarn("authentication failed", "proto", "socks5", "client", remoteAddr)
+			metrics.authFailures.inc("socks5")
 			return
 		}
+		user = login.username
+		defer policyFor(user).release()
+		logDebug("authentication successful", "proto", "socks5", "client", remoteAddr, "user", user)
+	} else if certUser != "" {
+		if !admitSocksUser(client, certUser, "socks5") {
+			return
+		}
+		user = certUser
+		defer policyFor(user).release()
+		logDebug("client certificate login", "proto", "socks5", "client", remoteAddr, "user", user)
 	}
 
 	// read (VER,CMD,RSV,ATYP)
 	if _, err := io.ReadFull(client, buf[:4]); err != nil {
-		if !cfg.isLogOff {
-			logChan <- fmt.Sprintf("SOCKS: request header error from %s: %v", client.RemoteAddr(), err)
-		}
+		logInfo("request header error", "proto", "socks5", "client", remoteAddr, "err", err)
 		return
 	}
 	version, cmd, _, addrType := buf[0], buf[1], buf[2], buf[3]
+	logTrace("request header", "proto", "socks5", "client", remoteAddr, "version", version, "cmd", cmd, "atyp", addrType)
 
-	if version != 0x05 || cmd != 0x01 {
+	if version != 0x05 || cmd < socksCmdConnect || cmd > socksCmdUDPAssociate {
+		logDebug("unsupported request", "proto", "socks5", "client", remoteAddr, "version", version, "cmd", cmd)
 		client.Write(socksResponseCmdNotSupported)
 		return
 	}
 
 	// parse destination
-	var dstIP net.IP
-	var dstStr string
+	var dstHost string
 
 	switch addrType {
 	case 0x01: // IPv4
 		if _, err := io.ReadFull(client, buf[:4]); err != nil {
 			return
 		}
-		dstIP = net.IPv4(buf[0], buf[1], buf[2], buf[3])
-		dstStr = dstIP.String()
+		dstHost = net.IP(buf[:4]).String()
 	case 0x03: // Domain
 		if _, err := io.ReadFull(client, buf[:1]); err != nil {
 			return
@@ -104,91 +188,86 @@ func handleSocks(client net.Conn) {
 		if _, err := io.ReadFull(client, buf[:domainLen]); err != nil {
 			return
 		}
-		domain := string(buf[:domainLen])
-		addrs, e := net.LookupIP(domain)
-		if e != nil || len(addrs) == 0 {
-			if !cfg.isLogOff {
-				logChan <- fmt.Sprintf("SOCKS: domain resolve fail %s from %s: %v", domain, client.RemoteAddr(), e)
-			}
-			client.Write(socksResponseHostUnreachable)
+		dstHost = string(buf[:domainLen])
+		if !validHostname(dstHost) {
+			logInfo("invalid host name", "proto", "socks5", "client", remoteAddr, "host", dstHost)
+			client.Write(socksResponseAddrNotSupported)
 			return
 		}
-		found := false
-		for _, a := range addrs {
-			if v4 := a.To4(); v4 != nil {
-				dstIP = v4
-				dstStr = domain
-				found = true
-				break
-			}
-		}
-		if !found {
-			if !cfg.isLogOff {
-				logChan <- fmt.Sprintf("SOCKS: no IPv4 found for domain=%s from %s", domain, client.RemoteAddr())
-			}
-			client.Write(socksResponseAddrNotSupported)
+	case 0x04: // IPv6
+		if _, err := io.ReadFull(client, buf[:16]); err != nil {
 			return
 		}
-	case 0x04:
-		client.Write(socksResponseAddrNotSupported)
-		return
+		dstHost = net.IP(buf[:16]).String()
 	default:
-		if !cfg.isLogOff {
-			logChan <- fmt.Sprintf("SOCKS: unknown addrType=%d from %s", addrType, client.RemoteAddr())
-		}
+		logInfo("unknown address type", "proto", "socks5", "client", remoteAddr, "atyp", addrType)
 		client.Write(socksResponseAddrNotSupported)
 		return
 	}
 
 	// read port
 	if _, err := io.ReadFull(client, buf[:2]); err != nil {
-		if !cfg.isLogOff {
-			logChan <- fmt.Sprintf("SOCKS: port read error from %s: %v", client.RemoteAddr(), err)
-		}
+		logInfo("port read error", "proto", "socks5", "client", remoteAddr, "err", err)
 		return
 	}
 	dstPort := binary.BigEndian.Uint16(buf[:2])
 
-	// dial - use strconv.Itoa instead of fmt.Sprintf for better performance
-	targetAddr := net.JoinHostPort(dstIP.String(), strconv.Itoa(int(dstPort)))
-	remote, err := net.Dial("tcp", targetAddr)
+	// use strconv.Itoa instead of fmt.Sprintf for better performance
+	targetAddr := net.JoinHostPort(dstHost, strconv.Itoa(int(dstPort)))
+	recDest := targetAddr
+	if cmd == socksCmdUDPAssociate {
+		// The address in a UDP ASSOCIATE request is the client's, not a destination
+		recDest = ""
+	}
+	rec := ci.newRecord("socks5", socksCmdName(cmd), recDest, user)
+	defer rec.done()
+	logDebug(rec.method+" request", "proto", "socks5", "client", remoteAddr, "dest", targetAddr)
+
+	if login != nil && cmd != socksCmdUDPAssociate && !webhookAllowsDestination(l, login, targetAddr) {
+		sendSocksResponse(client, rec, socksResponseNotAllowed)
+		return
+	}
+
+	switch cmd {
+	case socksCmdBind:
+		handleSocksBind(client, dstHost, user, rec.replier(socks5Replier(client)), rec)
+		return
+	case socksCmdUDPAssociate:
+		handleSocksUDPAssociate(client, dstPort, user, rec)
+		return
+	}
+
+	// Domains are resolved by the dialer, which tries both A and AAAA records
+	remote, err := dialTarget(targetAddr, user)
 	if err != nil {
-		client.Write(socksResponseConnRefused)
+		if isNotAllowed(err) {
+			logDebug("connect denied", "proto", "socks5", "client", remoteAddr, "dest", targetAddr, "err", err)
+			sendSocksResponse(client, rec, socksResponseNotAllowed)
+			return
+		}
+		if isDNSError(err) {
+			logInfo("domain resolve failed", "proto", "socks5", "client", remoteAddr, "host", dstHost, "err", err)
+			sendSocksResponse(client, rec, socksResponseHostUnreachable)
+			return
+		}
+		logDebug("connect failed", "proto", "socks5", "client", remoteAddr, "dest", targetAddr, "err", err)
+		sendSocksResponse(client, rec, socksResponseConnRefused)
 		return
 	}
+	rec.setRemote(remote)
 	// success
-	_, err = client.Write(socksResponseSuccess)
+	err = sendSocksResponse(client, rec, socksResponseSuccess)
 	if err != nil {
+		logDebug("sending success failed", "proto", "socks5", "client", remoteAddr, "err", err)
 		return
 	}
-	if !cfg.isLogOff {
-		logChan <- fmt.Sprintf("SOCKS: tunnel established %s <-> %s:%d", client.RemoteAddr(), dstStr, dstPort)
-	}
+	logInfo("tunnel established", "proto", "socks5", "client", remoteAddr, "dest", targetAddr)
+	defer observeTunnel("socks", time.Now())
 
 	defer remote.Close()
 	remote.SetDeadline(time.Now().Add(cfg.IdleTimeout))
 	defer remote.SetDeadline(time.Time{})
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Client -> Remote
-	go func() {
-		defer wg.Done()
-		copyWithPool(remote, client)
-		if tcpConn, ok := remote.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
-		}
-	}()
-
-	// Remote -> Client
-	go func() {
-		defer wg.Done()
-		copyWithPool(client, remote)
-		if tcpConn, ok := client.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
-		}
-	}()
-
-	wg.Wait()
+	relayTunnel(client, remote, rec)
+	logDebug("tunnel closed", "proto", "socks5", "client", remoteAddr, "dest", targetAddr)
 }
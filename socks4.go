@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SOCKS4 reply codes
+const (
+	socks4Granted  = 0x5A
+	socks4Rejected = 0x5B
+)
+
+// socks4Replier writes SOCKS4 replies to client, mapping SOCKS5 reply codes onto granted/rejected.
+// SOCKS4 replies can only carry IPv4 addresses; others are sent as 0.0.0.0.
+func socks4Replier(client net.Conn) socksReplier {
+	return func(rep byte, addr net.Addr) error {
+		reply := [8]byte{0x00, socks4Rejected}
+		if rep == 0x00 {
+			reply[1] = socks4Granted
+		}
+		if a, ok := addr.(*net.TCPAddr); ok {
+			if ip4 := a.IP.To4(); ip4 != nil {
+				binary.BigEndian.PutUint16(reply[2:4], uint16(a.Port))
+				copy(reply[4:8], ip4)
+			}
+		}
+		_, err := client.Write(reply[:])
+		return err
+	}
+}
+
+// readNulString reads a NUL-terminated field of at most 255 bytes
+func readNulString(r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0x00 {
+			return sb.String(), nil
+		}
+		if sb.Len() >= 255 {
+			return "", fmt.Errorf("field too long")
+		}
+		sb.WriteByte(b)
+	}
+}
+
+// handleSocks4 handles SOCKS4 and SOCKS4a requests after the version byte was read.
+// Request: CD(1) DSTPORT(2) DSTIP(4) USERID NUL [HOSTNAME NUL when DSTIP is 0.0.0.x]
+// SOCKS4 has no password field, so when auth is required USERID must be "username:password".
+func handleSocks4(client net.Conn, l *ListenerConfig, ci *connInfo) {
+	reply := socks4Replier(client)
+	// Requests are small; a reader lets the NUL-terminated fields be read without over-reading
+	reader := bufio.NewReaderSize(client, 512)
+
+	var hdr [7]byte
+	if _, err := io.ReadFull(reader, hdr[:]); err != nil {
+		return
+	}
+	cmd := hdr[0]
+	dstPort := binary.BigEndian.Uint16(hdr[1:3])
+	dstIP := net.IP(hdr[3:7])
+
+	userID, err := readNulString(reader)
+	if err != nil {
+		return
+	}
+
+	// SOCKS4a: 0.0.0.x with x != 0 means a hostname follows
+	dstHost := dstIP.String()
+	if hdr[3] == 0 && hdr[4] == 0 && hdr[5] == 0 && hdr[6] != 0 {
+		dstHost, err = readNulString(reader)
+		if err != nil {
+			return
+		}
+		if !validHostname(dstHost) {
+			logInfo("invalid host name", "proto", "socks4", "client", client.RemoteAddr(), "host", dstHost)
+			reply(0x08, nil)
+			return
+		}
+	}
+
+	// Keep anything the client pipelined after the request
+	client = &peekedConn{Conn: client, reader: reader}
+
+	targetAddr := net.JoinHostPort(dstHost, strconv.Itoa(int(dstPort)))
+	rec := ci.newRecord("socks4", socksCmdName(cmd), targetAddr, "")
+	defer rec.done()
+	reply = rec.replier(reply)
+
+	var user string
+	if l.AuthRequired {
+		// A verified client certificate replaces the USERID credentials
+		username := clientCertUser(l, client)
+		if username == "" {
+			name, password, _ := strings.Cut(userID, ":")
+			r := &authRequest{
+				username:    name,
+				password:    password,
+				clientIP:    remoteIP(client),
+				destination: targetAddr,
+				protocol:    "socks4",
+			}
+			if !checkCredentials(l, r) {
+				logWarn("authentication failed", "proto", "socks4", "client", client.RemoteAddr())
+				metrics.authFailures.inc("socks4")
+				reply(0x02, nil)
+				return
+			}
+			username = name
+		}
+		if !admitSocksUser(client, username, "socks4") {
+			reply(0x02, nil)
+			return
+		}
+		user = username
+		rec.setUser(user)
+		defer policyFor(user).release()
+	}
+
+	logDebug(rec.method+" request", "proto", "socks4", "client", client.RemoteAddr(), "dest", targetAddr)
+
+	switch cmd {
+	case socksCmdConnect:
+	case socksCmdBind:
+		handleSocksBind(client, dstHost, user, reply, rec)
+		return
+	default:
+		reply(0x07, nil)
+		return
+	}
+
+	remote, err := dialTarget(targetAddr, user)
+	if err != nil {
+		logDebug("connect failed", "proto", "socks4", "client", client.RemoteAddr(), "dest", targetAddr, "err", err)
+		reply(0x05, nil)
+		return
+	}
+	defer remote.Close()
+	rec.setRemote(remote)
+
+	if err := reply(0x00, remote.LocalAddr()); err != nil {
+		return
+	}
+	logInfo("tunnel established", "proto", "socks4", "client", client.RemoteAddr(), "dest", targetAddr)
+	defer observeTunnel("socks", time.Now())
+
+	remote.SetDeadline(time.Now().Add(cfg.IdleTimeout))
+	defer remote.SetDeadline(time.Time{})
+
+	relayTunnel(client, remote, rec)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often tls_cert / tls_key are checked for changes
+const certCheckInterval = 2 * time.Second
+
+// tlsVersions maps tls_min_version values to protocol versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion accepts "1.2" as well as "TLS1.2" / "tlsv1.2"
+func parseTLSVersion(val string) (uint16, error) {
+	v := strings.ToLower(val)
+	v = strings.TrimPrefix(strings.TrimPrefix(v, "tls"), "v")
+	if version, ok := tlsVersions[v]; ok {
+		return version, nil
+	}
+	return 0, fmt.Errorf("unknown tls_min_version %q (want 1.0, 1.1, 1.2 or 1.3)", val)
+}
+
+// certReloader serves a certificate and picks up renewed files without a restart
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// loadCertReloader reads a certificate and key; errors are fatal at startup
+func loadCertReloader(certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload re-reads both files, keeping the previous certificate if they don't form a valid pair
+func (r *certReloader) reload() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certMod, r.keyMod = certMod, keyMod
+	r.mu.Unlock()
+	return nil
+}
+
+// modTimes returns the modification times of the certificate and key files
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// watch reloads the pair whenever either file changes
+func (r *certReloader) watch() {
+	for range time.Tick(certCheckInterval) {
+		certMod, keyMod, err := r.modTimes()
+		if err != nil {
+			continue
+		}
+		r.mu.RLock()
+		changed := !certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := r.reload(); err != nil {
+			// The certificate is often written before the key; try again on the next change
+			logError("tls_cert reload failed, keeping previous certificate", "path", r.certPath, "err", err)
+			r.mu.Lock()
+			r.certMod, r.keyMod = certMod, keyMod
+			r.mu.Unlock()
+			continue
+		}
+		logInfo("tls_cert reloaded", "path", r.certPath)
+	}
+}
+
+// getCertificate hands the current certificate to the TLS handshake
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// setupTLS builds the TLS config of a listener with tls_cert and tls_key.
+// It runs after setupAuthBackends, since optional client certificates need a password backend.
+func setupTLS(cfg *Config, l *ListenerConfig) error {
+	if l.TLSCert == "" && l.TLSKey == "" {
+		if l.TLSClientCA != "" {
+			return fmt.Errorf("tls_client_ca needs tls_cert and tls_key")
+		}
+		return nil
+	}
+	if l.TLSCert == "" || l.TLSKey == "" {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+
+	// Listeners serving the same pair share one reloader
+	key := l.TLSCert + "\x00" + l.TLSKey
+	r, ok := cfg.certs[key]
+	if !ok {
+		var err error
+		r, err = loadCertReloader(l.TLSCert, l.TLSKey)
+		if err != nil {
+			return fmt.Errorf("tls_cert: %v", err)
+		}
+		cfg.certs[key] = r
+	}
+
+	l.tlsConfig = &tls.Config{
+		GetCertificate: r.getCertificate,
+		MinVersion:     l.TLSMinVersion,
+	}
+	if l.TLSClientCA == "" {
+		return nil
+	}
+
+	// Client certificates signed by tls_client_ca log users in (mTLS)
+	bundle, err := os.ReadFile(l.TLSClientCA)
+	if err != nil {
+		return fmt.Errorf("tls_client_ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return fmt.Errorf("tls_client_ca: no certificates found in %s", l.TLSClientCA)
+	}
+	l.tlsConfig.ClientCAs = pool
+	l.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if l.TLSClientAuth == "optional" {
+		if len(l.authBackends) == 0 {
+			return fmt.Errorf("tls_client_auth = optional needs auth_user/auth_pass, auth_file or auth_backend for clients without a certificate")
+		}
+		l.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+// clientCertUser returns the username taken from the verified client
+// certificate of c, or "" when there is none
+func clientCertUser(l *ListenerConfig, c net.Conn) string {
+	if l.TLSClientCA == "" {
+		return ""
+	}
+	for {
+		switch conn := c.(type) {
+		case *peekedConn:
+			c = conn.Conn
+		case *tls.Conn:
+			chains := conn.ConnectionState().VerifiedChains
+			if len(chains) == 0 {
+				return ""
+			}
+			return certUsername(chains[0][0], l.TLSClientUser)
+		default:
+			return ""
+		}
+	}
+}
+
+// certUsername reads the tls_client_user field of a certificate; for SANs the first entry counts
+func certUsername(cert *x509.Certificate, field string) string {
+	switch field {
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
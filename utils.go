@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 )
 
 // Buffer pool for efficient memory management
@@ -18,27 +21,100 @@ func initBufferPool() {
 	}
 }
 
+// copyCountChunk is how much is copied between updates of the byte counters
+const copyCountChunk = 64 * 1024
+
 // copyWithPool copies data between connections using pooled buffers
-func copyWithPool(dst io.Writer, src io.Reader) {
+// and adds the number of bytes copied to counter (an access record's bytesIn or bytesOut)
+func copyWithPool(dst io.Writer, src io.Reader, counter *atomic.Int64) (int64, error) {
 	buf, ok := bufPool.Get().([]byte)
 	if !ok {
 		buf = make([]byte, cfg.BufferSize) // Fallback to direct buffer set instead of sync.pool
 	}
 	defer bufPool.Put(buf) // Return to pool when done
 
-	_, _ = io.CopyBuffer(dst, src, buf)
+	// Copy in chunks so the counter moves while a tunnel is open; a
+	// LimitedReader still lets dst splice from src
+	var total int64
+	for {
+		n, err := io.CopyBuffer(dst, &io.LimitedReader{R: src, N: copyCountChunk}, buf)
+		counter.Add(n)
+		total += n
+		if err != nil || n < copyCountChunk {
+			return total, err
+		}
+	}
+}
+
+// relayTunnel copies between client and remote in both directions until both
+// are done, counting the bytes in rec. Each direction half-closes its
+// destination when its source ends.
+func relayTunnel(client, remote net.Conn, rec *accessRecord) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	// Client -> Remote
+	go func() {
+		defer wg.Done()
+		copyWithPool(remote, client, &rec.bytesIn)
+		closeWrite(remote)
+	}()
+
+	// Remote -> Client
+	copyWithPool(client, remote, &rec.bytesOut)
+	closeWrite(client)
+
+	wg.Wait()
+}
+
+// bufferedConn returns c, reading through r first when r holds bytes already read from c
+func bufferedConn(c net.Conn, r *bufio.Reader) net.Conn {
+	if r.Buffered() > 0 {
+		return &peekedConn{Conn: c, reader: r}
+	}
+	return c
+}
+
+// peekedConn is a net.Conn whose first bytes were already buffered by a reader
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads through the buffering reader so peeked bytes are not lost
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection
+func (c *peekedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// closeWrite half-closes c if it supports it, signalling EOF to the peer
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
 }
 
 // isAllowed checks if an IP address is allowed based on the configured networks
 func isAllowed(ip net.IP, networks []*net.IPNet) bool {
-	ip4 := ip.To4()
-	if ip4 == nil {
-		return false
+	// IPv4 clients on a dual-stack listener arrive as ::ffff:a.b.c.d
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
 	}
 	for _, n := range networks {
-		if n.Contains(ip4) {
+		if n.Contains(ip) {
 			return true
 		}
 	}
 	return false
 }
+
+// isDNSError reports whether a dial failed because the host name did not resolve
+func isDNSError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}